@@ -1,27 +1,34 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"os"
 	"os/signal"
+	"regexp"
 	"syscall"
 	"time"
 
+	"github.com/mohits-git/load-balancer/internal/breaker"
 	"github.com/mohits-git/load-balancer/internal/config"
+	"github.com/mohits-git/load-balancer/internal/health"
 	"github.com/mohits-git/load-balancer/internal/l4lb"
 	"github.com/mohits-git/load-balancer/internal/l7lb"
 	"github.com/mohits-git/load-balancer/internal/lbalgos"
+	"github.com/mohits-git/load-balancer/internal/outlier"
+	"github.com/mohits-git/load-balancer/internal/retry"
+	"github.com/mohits-git/load-balancer/internal/tlsconfig"
 	"github.com/mohits-git/load-balancer/internal/types"
 )
 
 func main() {
 	cfg := config.LoadConfig()
 
-	algo := lbalgos.NewLoadBalancerAlgorithm(cfg.Algorithm)
+	algo := lbalgos.NewLoadBalancerAlgorithm(cfg.Algorithm, algorithmOptions(cfg))
 
 	var lb types.LoadBalancer
 	switch cfg.Protocol {
-	case "http":
+	case "http", "grpc":
 		lb = SetupL7LoadBalancer(cfg, algo)
 	case "tcp":
 		lb = SetupL4LoadBalancer(cfg, algo)
@@ -46,11 +53,60 @@ func SetupL7LoadBalancer(cfg *config.Config, algo types.LoadBalancingAlgorithm)
 		time.Duration(cfg.HealthCheckInterval)*time.Second,
 		cfg.RetryLimit,
 	)
+	if cfg.Protocol == "grpc" {
+		lb.SetGRPCMode(true)
+	}
 	for _, server := range cfg.Servers {
-		httpServer := l7lb.NewHTTPServer(server.Addr, server.HealthCheckHTTPEndpoint)
-		httpServer.SetWeight(server.Weight)
-		lb.AddServer(httpServer)
-
+		lb.AddServer(newHTTPServer(cfg, server, cfg.UpstreamProtocol))
+	}
+	for name, upstream := range cfg.Upstreams {
+		upstreamProtocol := upstream.UpstreamProtocol
+		if upstreamProtocol == "" {
+			upstreamProtocol = cfg.UpstreamProtocol
+		}
+		lb.AddPool(name, upstreamAlgorithm(cfg, upstream),
+			time.Duration(upstream.HealthCheckInterval)*time.Second, upstream.RetryLimit)
+		for _, server := range upstream.Servers {
+			if server.HealthCheck == nil {
+				server.HealthCheck = upstream.HealthCheck
+			}
+			if server.CircuitBreaker == nil {
+				server.CircuitBreaker = upstream.CircuitBreaker
+			}
+			if err := lb.AddPoolServer(name, newHTTPServer(cfg, server, upstreamProtocol)); err != nil {
+				log.Fatalf("Invalid config for upstream %s: %v", name, err)
+			}
+		}
+	}
+	for _, route := range cfg.Routes {
+		if err := lb.AddRoute(httpRoute(route), route.Upstream); err != nil {
+			log.Fatalf("Invalid route to %s: %v", route.Upstream, err)
+		}
+	}
+	if cfg.RetryPolicy != nil {
+		lb.SetRetryPolicy(*retryPolicy(cfg.RetryPolicy))
+	}
+	if cfg.RetryBackoff != nil {
+		lb.SetBackoff(retryBackoff(cfg.RetryBackoff))
+	}
+	if cfg.RetryBudget != nil {
+		lb.SetRetryBudget(retryBudget(cfg.RetryBudget))
+	}
+	if cfg.RequestBuffer != nil {
+		lb.SetBodyBufferLimits(cfg.RequestBuffer.MemoryLimit, cfg.RequestBuffer.MaxSize)
+	}
+	if cfg.OutlierDetection != nil {
+		lb.EnableOutlierDetection(outlierConfig(cfg.OutlierDetection))
+	}
+	if cfg.TLS != nil {
+		lb.SetTLSConfig(listenerTLSConfig(cfg.TLS))
+		if headers := cfg.TLS.ClientCertHeaders; headers != nil {
+			lb.SetClientCertHeaders(l7lb.ClientCertHeaders{
+				Subject:     headers.Subject,
+				SANs:        headers.SANs,
+				Fingerprint: headers.Fingerprint,
+			})
+		}
 	}
 	return lb
 }
@@ -62,9 +118,378 @@ func SetupL4LoadBalancer(cfg *config.Config, algo types.LoadBalancingAlgorithm)
 		cfg.RetryLimit,
 	)
 	for _, server := range cfg.Servers {
-		tcpServer := l4lb.NewTCPServer(server.Addr)
-		tcpServer.SetWeight(server.Weight)
-		lb.AddServer(tcpServer)
+		lb.AddServer(newTCPServer(cfg, server))
+	}
+	for name, upstream := range cfg.Upstreams {
+		lb.AddPool(name, upstreamAlgorithm(cfg, upstream),
+			time.Duration(upstream.HealthCheckInterval)*time.Second, upstream.RetryLimit)
+		for _, server := range upstream.Servers {
+			if server.HealthCheck == nil {
+				server.HealthCheck = upstream.HealthCheck
+			}
+			if server.CircuitBreaker == nil {
+				server.CircuitBreaker = upstream.CircuitBreaker
+			}
+			if err := lb.AddPoolServer(name, newTCPServer(cfg, server)); err != nil {
+				log.Fatalf("Invalid config for upstream %s: %v", name, err)
+			}
+		}
+	}
+	if cfg.RetryBackoff != nil {
+		lb.SetBackoff(retryBackoff(cfg.RetryBackoff))
+	}
+	if cfg.RetryBudget != nil {
+		lb.SetRetryBudget(retryBudget(cfg.RetryBudget))
+	}
+	for _, route := range cfg.SNIRoutes {
+		if err := lb.AddSNIRoute(route.ServerNames, route.Upstream); err != nil {
+			log.Fatalf("Invalid sni route %v: %v", route.ServerNames, err)
+		}
+	}
+	if cfg.OutlierDetection != nil {
+		lb.EnableOutlierDetection(outlierConfig(cfg.OutlierDetection))
+	}
+	if cfg.TLS != nil {
+		lb.SetTLSConfig(listenerTLSConfig(cfg.TLS))
 	}
 	return lb
 }
+
+// builds the server talking upstreamProtocol (the pool's or the top level one),
+// grpc needs http/2 so grpc mode defaults to h2c, or h2 over tls
+func newHTTPServer(cfg *config.Config, server config.Server, upstreamProtocol string) *l7lb.HTTPServer {
+	httpServer := l7lb.NewHTTPServer(server.Addr, server.HealthCheckHTTPEndpoint)
+	httpServer.SetWeight(server.Weight)
+	if server.TLS != nil {
+		httpServer.SetTLSConfig(upstreamTLS(server))
+	}
+	if cfg.Protocol == "grpc" && upstreamProtocol == "" {
+		upstreamProtocol = "h2c"
+		if server.TLS != nil {
+			upstreamProtocol = "h2"
+		}
+	}
+	if err := httpServer.SetUpstreamProtocol(upstreamProtocol); err != nil {
+		log.Fatalf("Invalid config for %s: %v", server.Addr, err)
+	}
+	// grpc backends are checked with the grpc health protocol by default
+	// and tls backends are probed over tls
+	if server.HealthCheck == nil && (cfg.Protocol == "grpc" || server.TLS != nil) {
+		server.HealthCheck = &config.HealthCheck{}
+	}
+	if server.HealthCheck != nil {
+		httpServer.SetHealthCheck(healthConfig(server.HealthCheck), healthChecker(server, cfg.Protocol))
+	}
+	if b := circuitBreaker(cfg, server); b != nil {
+		httpServer.SetCircuitBreaker(b)
+	}
+	return httpServer
+}
+
+func httpRoute(cfg config.Route) l7lb.Route {
+	route := l7lb.Route{
+		Name:       cfg.Name,
+		Host:       cfg.Host,
+		PathPrefix: cfg.PathPrefix,
+		Methods:    cfg.Methods,
+		Headers:    cfg.Headers,
+	}
+	if cfg.PathRegex != "" {
+		re, err := regexp.Compile(cfg.PathRegex)
+		if err != nil {
+			log.Fatalf("Invalid route path regex %q: %v", cfg.PathRegex, err)
+		}
+		route.PathRegex = re
+	}
+	if route.Name == "" {
+		route.Name = cfg.Upstream
+	}
+	if cfg.Rewrite != nil {
+		route.Rewrite = httpRewrite(cfg.Rewrite)
+	}
+	if redirect := cfg.Redirect; redirect != nil {
+		route.Redirect = &l7lb.Redirect{
+			StatusCode:        redirect.StatusCode,
+			Scheme:            redirect.Scheme,
+			Host:              redirect.Host,
+			Port:              redirect.Port,
+			Path:              redirect.Path,
+			PrefixReplacement: redirect.PrefixReplacement,
+			StripQuery:        redirect.StripQuery,
+		}
+	}
+	if cfg.DirectResponse != nil {
+		route.DirectResponse = directResponse(cfg.DirectResponse)
+	}
+	if cfg.RetryPolicy != nil {
+		route.RetryPolicy = retryPolicy(cfg.RetryPolicy)
+	}
+	if hedging := cfg.Hedging; hedging != nil {
+		policy := l7lb.HedgePolicy{
+			Percentile: hedging.Percentile,
+			MinDelay:   time.Duration(hedging.MinDelayMs) * time.Millisecond,
+			MaxDelay:   time.Duration(hedging.MaxDelayMs) * time.Millisecond,
+		}.WithDefaults()
+		route.HedgePolicy = &policy
+	}
+	return route
+}
+
+func retryPolicy(cfg *config.RetryPolicy) *l7lb.RetryPolicy {
+	policy, err := l7lb.ParseRetryOn(cfg.RetryOn)
+	if err != nil {
+		log.Fatalf("Invalid retry policy: %v", err)
+	}
+	policy.RetryLimit = cfg.RetryLimit
+	policy.NonIdempotent = cfg.RetryNonIdempotent
+	return &policy
+}
+
+func directResponse(cfg *config.DirectResponse) *l7lb.DirectResponse {
+	resp := &l7lb.DirectResponse{
+		StatusCode: cfg.StatusCode,
+		Headers:    cfg.Headers,
+		Body:       []byte(cfg.Body),
+	}
+	if cfg.BodyFile != "" {
+		body, err := os.ReadFile(cfg.BodyFile)
+		if err != nil {
+			log.Fatalf("Error reading direct response body file: %v", err)
+		}
+		resp.Body = body
+	}
+	return resp
+}
+
+func httpRewrite(cfg *config.Rewrite) *l7lb.Rewrite {
+	rewrite := &l7lb.Rewrite{
+		StripPrefix:     cfg.StripPrefix,
+		PathReplacement: cfg.PathReplacement,
+		AddPrefix:       cfg.AddPrefix,
+		RequestHeaders:  edits(cfg.RequestHeaders),
+		ResponseHeaders: edits(cfg.ResponseHeaders),
+		Query:           edits(cfg.Query),
+	}
+	if cfg.PathRegex != "" {
+		re, err := regexp.Compile(cfg.PathRegex)
+		if err != nil {
+			log.Fatalf("Invalid rewrite path regex %q: %v", cfg.PathRegex, err)
+		}
+		rewrite.PathRegex = re
+	}
+	return rewrite
+}
+
+func edits(cfg *config.Edits) l7lb.Edits {
+	if cfg == nil {
+		return l7lb.Edits{}
+	}
+	return l7lb.Edits{Set: cfg.Set, Append: cfg.Append, Remove: cfg.Remove}
+}
+
+// returns the upstream's algorithm, defaults to the top level algorithm
+func upstreamAlgorithm(cfg *config.Config, upstream config.Upstream) types.LoadBalancingAlgorithm {
+	algorithm := upstream.Algorithm
+	if algorithm == "" {
+		algorithm = cfg.Algorithm
+	}
+	return lbalgos.NewLoadBalancerAlgorithm(algorithm, algorithmOptions(cfg))
+}
+
+func newTCPServer(cfg *config.Config, server config.Server) *l4lb.TCPServer {
+	tcpServer := l4lb.NewTCPServer(server.Addr)
+	tcpServer.SetWeight(server.Weight)
+	if server.TLS != nil {
+		tcpServer.SetTLSConfig(upstreamTLS(server))
+		// tls backends are probed over tls
+		if server.HealthCheck == nil {
+			server.HealthCheck = &config.HealthCheck{}
+		}
+	}
+	if server.HealthCheck != nil {
+		tcpServer.SetHealthCheck(healthConfig(server.HealthCheck), healthChecker(server, "tcp"))
+	}
+	if b := circuitBreaker(cfg, server); b != nil {
+		tcpServer.SetCircuitBreaker(b)
+	}
+	return tcpServer
+}
+
+func algorithmOptions(cfg *config.Config) lbalgos.Options {
+	return lbalgos.Options{
+		HashKey:         cfg.HashKey,
+		VirtualNodes:    cfg.VirtualNodes,
+		MaglevTableSize: cfg.MaglevTableSize,
+	}
+}
+
+func listenerTLSConfig(cfg *config.ListenerTLS) *tls.Config {
+	opts := tlsconfig.ServerOptions{
+		MinVersion:     cfg.MinVersion,
+		CipherSuites:   cfg.CipherSuites,
+		ALPN:           cfg.ALPN,
+		ReloadInterval: time.Duration(cfg.ReloadInterval) * time.Second,
+		ClientAuth:     cfg.ClientAuth,
+		ClientCAFile:   cfg.ClientCAFile,
+	}
+	if cfg.CertFile != "" {
+		opts.Certificates = append(opts.Certificates, tlsconfig.CertKeyPair{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile})
+	}
+	for _, cert := range cfg.Certificates {
+		opts.Certificates = append(opts.Certificates, tlsconfig.CertKeyPair{CertFile: cert.CertFile, KeyFile: cert.KeyFile})
+	}
+	tlsConfig, err := tlsconfig.NewServerConfig(opts)
+	if err != nil {
+		log.Fatalf("Invalid tls config: %v", err)
+	}
+	return tlsConfig
+}
+
+func retryBackoff(cfg *config.RetryBackoff) retry.Backoff {
+	return retry.Backoff{
+		Base: time.Duration(cfg.BaseMs) * time.Millisecond,
+		Max:  time.Duration(cfg.MaxMs) * time.Millisecond,
+	}
+}
+
+func retryBudget(cfg *config.RetryBudget) *retry.Budget {
+	return retry.NewBudget(retry.BudgetConfig{
+		Percent:    cfg.Percent,
+		MinRetries: cfg.MinRetries,
+		Window:     time.Duration(cfg.Window) * time.Second,
+	})
+}
+
+// returns a new circuit breaker for the server, configured by the server's
+// settings or the top level ones, nil when neither is set
+func circuitBreaker(cfg *config.Config, server config.Server) *breaker.Breaker {
+	cb := server.CircuitBreaker
+	if cb == nil {
+		cb = cfg.CircuitBreaker
+	}
+	if cb == nil {
+		return nil
+	}
+	return breaker.New(server.Addr, breaker.Config{
+		ConsecutiveFailures: cb.ConsecutiveFailures,
+		ErrorRatePercent:    cb.ErrorRatePercent,
+		MinRequests:         cb.MinRequests,
+		Window:              time.Duration(cb.Window) * time.Second,
+		OpenTimeout:         time.Duration(cb.OpenTimeout) * time.Second,
+		HalfOpenRequests:    cb.HalfOpenRequests,
+		MaxPending:          cb.MaxPending,
+		MaxConnections:      cb.MaxConnections,
+	})
+}
+
+func outlierConfig(cfg *config.OutlierDetection) outlier.Config {
+	return outlier.Config{
+		ConsecutiveErrors:  cfg.ConsecutiveErrors,
+		BaseEjectionTime:   time.Duration(cfg.BaseEjectionTime) * time.Second,
+		MaxEjectionTime:    time.Duration(cfg.MaxEjectionTime) * time.Second,
+		MaxEjectionPercent: cfg.MaxEjectionPercent,
+	}
+}
+
+func healthConfig(cfg *config.HealthCheck) health.Config {
+	return health.Config{
+		Interval: time.Duration(cfg.Interval) * time.Second,
+		Timeout:  time.Duration(cfg.Timeout) * time.Second,
+		Rise:     cfg.Rise,
+		Fall:     cfg.Fall,
+	}
+}
+
+// builds the server's health check, the check type defaults to the load balancer protocol
+func healthChecker(server config.Server, protocol string) health.Checker {
+	checkType := server.HealthCheck.Type
+	if checkType == "" {
+		checkType = protocol
+	}
+	switch checkType {
+	case "http":
+		return httpHealthCheck(server)
+	case "tcp":
+		return tcpHealthCheck(server)
+	case "grpc":
+		return grpcHealthCheck(server)
+	}
+	log.Fatalf("Invalid health check type %q for %s", checkType, server.Addr)
+	return nil
+}
+
+func httpHealthCheck(server config.Server) *health.HTTPCheck {
+	cfg := server.HealthCheck
+	check := &health.HTTPCheck{
+		Method:       cfg.Method,
+		Path:         server.HealthCheckHTTPEndpoint,
+		Headers:      cfg.Headers,
+		BodyContains: cfg.BodyContains,
+	}
+	if cfg.Path != "" {
+		check.Path = cfg.Path
+	}
+	statuses, err := health.ParseStatusRanges(cfg.ExpectedStatuses)
+	if err != nil {
+		log.Fatalf("Invalid health check config for %s: %v", server.Addr, err)
+	}
+	check.ExpectedStatuses = statuses
+	check.TLS = healthCheckTLS(server)
+	if cfg.BodyRegex != "" {
+		re, err := regexp.Compile(cfg.BodyRegex)
+		if err != nil {
+			log.Fatalf("Invalid health check body regex for %s: %v", server.Addr, err)
+		}
+		check.BodyRegex = re
+	}
+	return check
+}
+
+func tcpHealthCheck(server config.Server) *health.TCPCheck {
+	cfg := server.HealthCheck
+	check := &health.TCPCheck{}
+	for _, step := range cfg.Script {
+		check.Steps = append(check.Steps, health.TCPStep{Send: step.Send, Expect: step.Expect})
+	}
+	check.TLS = healthCheckTLS(server)
+	return check
+}
+
+func grpcHealthCheck(server config.Server) *health.GRPCCheck {
+	return health.NewGRPCCheck(server.HealthCheck.Service, healthCheckTLS(server))
+}
+
+// returns the health check's client tls config, defaults to the
+// server's upstream tls, nil for plaintext checks
+func healthCheckTLS(server config.Server) *tls.Config {
+	if server.HealthCheck.TLS == nil {
+		if server.TLS == nil {
+			return nil
+		}
+		return upstreamTLS(server)
+	}
+	tlsConfig, err := tlsconfig.NewClientConfig(clientTLSOptions(server.HealthCheck.TLS))
+	if err != nil {
+		log.Fatalf("Invalid health check tls config for %s: %v", server.Addr, err)
+	}
+	return tlsConfig
+}
+
+// returns the client tls config for connections to the server
+func upstreamTLS(server config.Server) *tls.Config {
+	tlsConfig, err := tlsconfig.NewClientConfig(clientTLSOptions(server.TLS))
+	if err != nil {
+		log.Fatalf("Invalid tls config for %s: %v", server.Addr, err)
+	}
+	return tlsConfig
+}
+
+func clientTLSOptions(cfg *config.ClientTLS) tlsconfig.ClientOptions {
+	return tlsconfig.ClientOptions{
+		CAFile:             cfg.CAFile,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		CertFile:           cfg.CertFile,
+		KeyFile:            cfg.KeyFile,
+	}
+}
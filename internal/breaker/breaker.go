@@ -0,0 +1,281 @@
+// breaker implements per backend circuit breakers, backends failing too often
+// stop getting requests until a trial request succeeds after a cool down
+package breaker
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// returned instead of sending a request the breaker doesn't let through
+var (
+	ErrOpen               = errors.New("circuit breaker open")
+	ErrTooManyRequests    = errors.New("circuit breaker max pending requests reached")
+	ErrTooManyConnections = errors.New("circuit breaker max connections reached")
+)
+
+// reports whether err is a request the breaker didn't let through, such
+// requests never reached the backend
+func IsRejection(err error) bool {
+	return errors.Is(err, ErrOpen) || errors.Is(err, ErrTooManyRequests) || errors.Is(err, ErrTooManyConnections)
+}
+
+type State int
+
+const (
+	// requests flow, failures are counted
+	Closed State = iota
+	// requests are rejected until OpenTimeout is over
+	Open
+	// a limited number of trial requests decide whether to close or reopen
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type Config struct {
+	// consecutive failures that open the breaker
+	ConsecutiveFailures int
+	// error rate (percentage) over the window that opens the breaker
+	ErrorRatePercent int
+	// requests needed in the window before the error rate is considered
+	MinRequests int
+	// rolling window the error rate is computed over
+	Window time.Duration
+	// time the breaker stays open before letting trial requests through
+	OpenTimeout time.Duration
+	// trial requests in the half-open state, all of them have to succeed to close
+	HalfOpenRequests int
+	// max requests in flight to the backend, 0 for no limit
+	MaxPending int
+	// max concurrent connections to the backend, 0 for no limit
+	MaxConnections int
+}
+
+// fills unset values with the defaults: 5 consecutive failures, 50% error rate
+// over at least 20 requests in a 10s window, 30s open, 1 trial request
+func (cfg Config) WithDefaults() Config {
+	if cfg.ConsecutiveFailures <= 0 {
+		cfg.ConsecutiveFailures = 5
+	}
+	if cfg.ErrorRatePercent <= 0 || cfg.ErrorRatePercent > 100 {
+		cfg.ErrorRatePercent = 50
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.Window < time.Second {
+		cfg.Window = 10 * time.Second
+	}
+	if cfg.OpenTimeout <= 0 {
+		cfg.OpenTimeout = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests <= 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return cfg
+}
+
+// Breaker tracks the outcomes of a backend's requests and rejects requests
+// while the backend is failing
+type Breaker struct {
+	name     string
+	cfg      Config
+	state    State
+	openedAt time.Time
+	// incremented on every state change, requests are tagged with the
+	// generation they were admitted in
+	generation          uint64
+	consecutiveFailures int
+	buckets             []outcomeBucket
+	// requests admitted and not done yet
+	pending int
+	// trial requests admitted and succeeded in the half-open state
+	trials    int
+	successes int
+	now       func() time.Time
+	mu        *sync.Mutex
+}
+
+// outcomes of one second of the window
+type outcomeBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+// returns a closed breaker, name is used in logs
+func New(name string, cfg Config) *Breaker {
+	cfg = cfg.WithDefaults()
+	return &Breaker{
+		name:    name,
+		cfg:     cfg,
+		state:   Closed,
+		buckets: make([]outcomeBucket, int(cfg.Window/time.Second)),
+		now:     time.Now,
+		mu:      &sync.Mutex{},
+	}
+}
+
+// returns the breaker's config
+func (b *Breaker) Config() Config {
+	return b.cfg
+}
+
+// returns the current state, an open breaker past its timeout is half-open
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState(b.now())
+}
+
+// reports whether a request would be let through now, without taking a slot
+func (b *Breaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState(b.now()) {
+	case Open:
+		return false
+	case HalfOpen:
+		if b.trials >= b.cfg.HalfOpenRequests {
+			return false
+		}
+	}
+	return b.cfg.MaxPending <= 0 || b.pending < b.cfg.MaxPending
+}
+
+// admits a request, the caller has to report its outcome with Done and the
+// returned generation. returns ErrOpen or ErrTooManyRequests when the request
+// shouldn't be sent
+func (b *Breaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.currentState(b.now())
+	if state == Open || (state == HalfOpen && b.trials >= b.cfg.HalfOpenRequests) {
+		return 0, ErrOpen
+	}
+	if b.cfg.MaxPending > 0 && b.pending >= b.cfg.MaxPending {
+		return 0, ErrTooManyRequests
+	}
+	if state == HalfOpen {
+		b.trials++
+	}
+	b.pending++
+	return b.generation, nil
+}
+
+// records the outcome of a request admitted by Allow in generation. outcomes
+// of requests admitted before the last state change don't count, e.g. a request
+// sent while closed finishing in the half-open state isn't a trial
+func (b *Breaker) Done(generation uint64, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending--
+	now := b.now()
+
+	state := b.currentState(now)
+	if generation != b.generation {
+		return
+	}
+	switch state {
+	case HalfOpen:
+		if !success {
+			b.open(now, "trial request failed")
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.close()
+		}
+		return
+	case Open:
+		return // not admitted while open
+	}
+
+	bucket := b.bucket(now)
+	bucket.requests++
+	if success {
+		b.consecutiveFailures = 0
+		return
+	}
+	bucket.failures++
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= b.cfg.ConsecutiveFailures {
+		b.open(now, "consecutive failures")
+		return
+	}
+	requests, failures := b.windowCounts(now)
+	if requests >= b.cfg.MinRequests && failures*100 >= requests*b.cfg.ErrorRatePercent {
+		b.open(now, "error rate")
+	}
+}
+
+// ends a request admitted by Allow in generation without recording an outcome,
+// e.g. when the client cancelled it. a half-open trial slot is freed for another request
+func (b *Breaker) Release(generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending--
+	if b.currentState(b.now()) == HalfOpen && generation == b.generation {
+		b.trials--
+	}
+}
+
+func (b *Breaker) currentState(now time.Time) State {
+	if b.state == Open && now.Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.state = HalfOpen
+		b.generation++
+		b.trials, b.successes = 0, 0
+		log.Printf("Circuit breaker of %s half-open\n", b.name)
+	}
+	return b.state
+}
+
+func (b *Breaker) open(now time.Time, reason string) {
+	log.Printf("Circuit breaker of %s open: %s\n", b.name, reason)
+	b.state = Open
+	b.generation++
+	b.openedAt = now
+	b.consecutiveFailures = 0
+}
+
+func (b *Breaker) close() {
+	log.Printf("Circuit breaker of %s closed\n", b.name)
+	b.state = Closed
+	b.generation++
+	b.consecutiveFailures = 0
+	clear(b.buckets)
+}
+
+// returns the requests and failures of the window
+func (b *Breaker) windowCounts(now time.Time) (int, int) {
+	requests, failures := 0, 0
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// returns the bucket of the current second, resetting it when it held an older second
+func (b *Breaker) bucket(now time.Time) *outcomeBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = outcomeBucket{second: second}
+	}
+	return bucket
+}
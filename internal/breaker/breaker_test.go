@@ -0,0 +1,238 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// returns a breaker whose clock only moves when advance is called
+func newTestBreaker(cfg Config) (*Breaker, func(time.Duration)) {
+	b := New("test", cfg)
+	now := time.Unix(1_000_000, 0)
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+// admits a request, failing the test when the breaker rejects it
+func admit(t *testing.T, b *Breaker) uint64 {
+	t.Helper()
+	generation, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Allow() = %v, want nil (state %s)", err, b.State())
+	}
+	return generation
+}
+
+// sends n requests one after the other with the same outcome
+func send(t *testing.T, b *Breaker, n int, success bool) {
+	t.Helper()
+	for range n {
+		b.Done(admit(t, b), success)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		run  func(t *testing.T, b *Breaker, advance func(time.Duration))
+		want State
+	}{
+		{
+			name: "successes keep it closed",
+			cfg:  Config{ConsecutiveFailures: 3},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 2, false)
+				send(t, b, 1, true)
+				send(t, b, 2, false)
+			},
+			want: Closed,
+		},
+		{
+			name: "consecutive failures open it",
+			cfg:  Config{ConsecutiveFailures: 3},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 3, false)
+				if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+					t.Fatalf("Allow() = %v, want ErrOpen", err)
+				}
+				if b.Available() {
+					t.Fatal("Available() = true while open")
+				}
+			},
+			want: Open,
+		},
+		{
+			name: "error rate opens it",
+			cfg:  Config{ConsecutiveFailures: 100, ErrorRatePercent: 50, MinRequests: 10},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				for range 5 {
+					send(t, b, 1, true)
+					send(t, b, 1, false)
+				}
+			},
+			want: Open,
+		},
+		{
+			name: "error rate needs min requests",
+			cfg:  Config{ConsecutiveFailures: 100, ErrorRatePercent: 50, MinRequests: 10},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 4, true)
+				send(t, b, 5, false)
+			},
+			want: Closed,
+		},
+		{
+			name: "failures older than the window don't count",
+			cfg:  Config{ConsecutiveFailures: 100, ErrorRatePercent: 50, MinRequests: 10, Window: 10 * time.Second},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 9, false)
+				send(t, b, 1, true)
+				advance(11 * time.Second)
+				send(t, b, 5, true)
+				send(t, b, 4, false)
+			},
+			want: Closed,
+		},
+		{
+			name: "half-open after the open timeout",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: 30 * time.Second},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 1, false)
+				advance(29 * time.Second)
+				if b.State() != Open {
+					t.Fatalf("state = %s before the open timeout, want open", b.State())
+				}
+				advance(time.Second)
+			},
+			want: HalfOpen,
+		},
+		{
+			name: "successful trials close it",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenRequests: 2},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 1, false)
+				advance(time.Second)
+				send(t, b, 1, true)
+				if b.State() != HalfOpen {
+					t.Fatalf("state = %s after one of two trials, want half-open", b.State())
+				}
+				send(t, b, 1, true)
+			},
+			want: Closed,
+		},
+		{
+			name: "failed trial reopens it",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: time.Second},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 1, false)
+				advance(time.Second)
+				send(t, b, 1, false)
+			},
+			want: Open,
+		},
+		{
+			name: "only half-open requests trials are admitted",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenRequests: 1},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 1, false)
+				advance(time.Second)
+				admit(t, b)
+				if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+					t.Fatalf("second trial Allow() = %v, want ErrOpen", err)
+				}
+				if b.Available() {
+					t.Fatal("Available() = true with every trial slot taken")
+				}
+			},
+			want: HalfOpen,
+		},
+		{
+			name: "max pending rejects requests",
+			cfg:  Config{MaxPending: 2},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				first := admit(t, b)
+				admit(t, b)
+				if _, err := b.Allow(); !errors.Is(err, ErrTooManyRequests) {
+					t.Fatalf("Allow() = %v, want ErrTooManyRequests", err)
+				}
+				if b.Available() {
+					t.Fatal("Available() = true with max pending requests")
+				}
+				b.Done(first, true)
+				admit(t, b)
+			},
+			want: Closed,
+		},
+		{
+			name: "max pending rejection keeps the trial slot",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenRequests: 2, MaxPending: 1},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 1, false)
+				advance(time.Second)
+				first := admit(t, b)
+				if _, err := b.Allow(); !errors.Is(err, ErrTooManyRequests) {
+					t.Fatalf("Allow() = %v, want ErrTooManyRequests", err)
+				}
+				b.Done(first, true)
+				send(t, b, 1, true)
+			},
+			want: Closed,
+		},
+		{
+			name: "released trial frees its slot",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenRequests: 1},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				send(t, b, 1, false)
+				advance(time.Second)
+				b.Release(admit(t, b))
+				if b.State() != HalfOpen {
+					t.Fatalf("state = %s after a released trial, want half-open", b.State())
+				}
+				if !b.Available() {
+					t.Fatal("Available() = false after the trial was released")
+				}
+				admit(t, b)
+			},
+			want: HalfOpen,
+		},
+		{
+			name: "released request frees its pending slot",
+			cfg:  Config{ConsecutiveFailures: 1, MaxPending: 1},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				b.Release(admit(t, b))
+				send(t, b, 1, true)
+			},
+			want: Closed,
+		},
+		{
+			name: "requests from before don't count as trials",
+			cfg:  Config{ConsecutiveFailures: 1, OpenTimeout: time.Second},
+			run: func(t *testing.T, b *Breaker, advance func(time.Duration)) {
+				old := admit(t, b)
+				oldFailing := admit(t, b)
+				send(t, b, 1, false)
+				advance(time.Second)
+				trial := admit(t, b)
+				b.Done(old, true)
+				b.Done(oldFailing, false)
+				if b.State() != HalfOpen {
+					t.Fatalf("state = %s after requests from before finished, want half-open", b.State())
+				}
+				b.Done(trial, false)
+			},
+			want: Open,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, advance := newTestBreaker(tt.cfg)
+			tt.run(t, b, advance)
+			if got := b.State(); got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,18 +8,228 @@ import (
 )
 
 type Config struct {
-	Protocol            string   `json:"protocol"`
-	Port                int      `json:"port"`
-	Algorithm           string   `json:"algorithm"`
-	HealthCheckInterval int      `json:"healthCheckInterval"`
-	RetryLimit          int      `json:"retryLimit"`
-	Servers             []Server `json:"servers"`
+	Protocol            string              `json:"protocol"`
+	Port                int                 `json:"port"`
+	TLS                 *ListenerTLS        `json:"tls"`
+	UpstreamProtocol    string              `json:"upstreamProtocol"`
+	Algorithm           string              `json:"algorithm"`
+	HashKey             string              `json:"hashKey"`
+	VirtualNodes        int                 `json:"virtualNodes"`
+	MaglevTableSize     int                 `json:"maglevTableSize"`
+	HealthCheckInterval int                 `json:"healthCheckInterval"`
+	RetryLimit          int                 `json:"retryLimit"`
+	RetryPolicy         *RetryPolicy        `json:"retryPolicy"`
+	RetryBackoff        *RetryBackoff       `json:"retryBackoff"`
+	RetryBudget         *RetryBudget        `json:"retryBudget"`
+	RequestBuffer       *RequestBuffer      `json:"requestBuffer"`
+	Servers             []Server            `json:"servers"`
+	OutlierDetection    *OutlierDetection   `json:"outlierDetection"`
+	CircuitBreaker      *CircuitBreaker     `json:"circuitBreaker"`
+	Upstreams           map[string]Upstream `json:"upstreams"`
+	SNIRoutes           []SNIRoute          `json:"sniRoutes"`
+	Routes              []Route             `json:"routes"`
+}
+
+// named pool of backend servers, settings default to the top level ones,
+// healthCheck and circuitBreaker apply to the servers without their own
+type Upstream struct {
+	Algorithm           string          `json:"algorithm"`
+	UpstreamProtocol    string          `json:"upstreamProtocol"`
+	HealthCheckInterval int             `json:"healthCheckInterval"`
+	RetryLimit          int             `json:"retryLimit"`
+	HealthCheck         *HealthCheck    `json:"healthCheck"`
+	CircuitBreaker      *CircuitBreaker `json:"circuitBreaker"`
+	Servers             []Server        `json:"servers"`
+}
+
+// tcp mode, routes tls connections whose SNI matches serverNames to the upstream
+type SNIRoute struct {
+	ServerNames []string `json:"serverNames"`
+	Upstream    string   `json:"upstream"`
+}
+
+// http and grpc modes, sends requests matching every set condition to the upstream
+type Route struct {
+	Name           string            `json:"name"`
+	Host           string            `json:"host"`
+	PathPrefix     string            `json:"pathPrefix"`
+	PathRegex      string            `json:"pathRegex"`
+	Methods        []string          `json:"methods"`
+	Headers        map[string]string `json:"headers"`
+	Upstream       string            `json:"upstream"`
+	Rewrite        *Rewrite          `json:"rewrite"`
+	Redirect       *Redirect         `json:"redirect"`
+	DirectResponse *DirectResponse   `json:"directResponse"`
+	RetryPolicy    *RetryPolicy      `json:"retryPolicy"`
+	Hedging        *Hedging          `json:"hedging"`
+}
+
+// http mode, which failed requests are retried, retryOn lists
+// "connect-failure" | "reset" | "timeout" | "5xx" | status codes
+type RetryPolicy struct {
+	RetryOn            []string `json:"retryOn"`
+	RetryLimit         int      `json:"retryLimit"`
+	RetryNonIdempotent bool     `json:"retryNonIdempotent"`
+}
+
+// http mode, sends a copy of slow idempotent requests to a second backend after
+// the percentile of the first backend's latency, bounded by minDelayMs and maxDelayMs
+type Hedging struct {
+	Percentile float64 `json:"percentile"`
+	MinDelayMs int     `json:"minDelayMs"`
+	MaxDelayMs int     `json:"maxDelayMs"`
+}
+
+// jittered exponential backoff between retries, in milliseconds
+type RetryBackoff struct {
+	BaseMs int `json:"baseMs"`
+	MaxMs  int `json:"maxMs"`
+}
+
+// caps retries to percent of the requests in the last window seconds,
+// minRetries are always allowed
+type RetryBudget struct {
+	Percent    float64 `json:"percent"`
+	MinRetries int     `json:"minRetries"`
+	Window     int     `json:"window"`
+}
+
+// http mode, request body buffering for retries, sizes in bytes
+type RequestBuffer struct {
+	MemoryLimit int64 `json:"memoryLimit"`
+	MaxSize     int64 `json:"maxSize"`
+}
+
+// answers matched requests with a redirect to the request url with the set parts replaced
+type Redirect struct {
+	StatusCode        int    `json:"statusCode"`
+	Scheme            string `json:"scheme"`
+	Host              string `json:"host"`
+	Port              int    `json:"port"`
+	Path              string `json:"path"`
+	PrefixReplacement string `json:"prefixReplacement"`
+	StripQuery        bool   `json:"stripQuery"`
+}
+
+// answers matched requests with a fixed response, the body is body or the content of bodyFile
+type DirectResponse struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	BodyFile   string            `json:"bodyFile"`
+}
+
+// request and response transformations of a route
+type Rewrite struct {
+	StripPrefix     string `json:"stripPrefix"`
+	PathRegex       string `json:"pathRegex"`
+	PathReplacement string `json:"pathReplacement"`
+	AddPrefix       string `json:"addPrefix"`
+	RequestHeaders  *Edits `json:"requestHeaders"`
+	ResponseHeaders *Edits `json:"responseHeaders"`
+	Query           *Edits `json:"query"`
+}
+
+// removes, then sets and then appends header or query values by name
+type Edits struct {
+	Set    map[string]string `json:"set"`
+	Append map[string]string `json:"append"`
+	Remove []string          `json:"remove"`
+}
+
+// passive health checking settings, times are in seconds
+type OutlierDetection struct {
+	ConsecutiveErrors  int `json:"consecutiveErrors"`
+	BaseEjectionTime   int `json:"baseEjectionTime"`
+	MaxEjectionTime    int `json:"maxEjectionTime"`
+	MaxEjectionPercent int `json:"maxEjectionPercent"`
+}
+
+// per backend circuit breaker settings, times are in seconds. every server gets
+// its own breaker, opened by consecutiveFailures or by errorRatePercent over
+// at least minRequests in the window
+type CircuitBreaker struct {
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	ErrorRatePercent    int `json:"errorRatePercent"`
+	MinRequests         int `json:"minRequests"`
+	Window              int `json:"window"`
+	OpenTimeout         int `json:"openTimeout"`
+	HalfOpenRequests    int `json:"halfOpenRequests"`
+	MaxPending          int `json:"maxPending"`
+	MaxConnections      int `json:"maxConnections"`
 }
 
 type Server struct {
-	Addr                    string `json:"addr"`
-	HealthCheckHTTPEndpoint string `json:"healthCheckHTTPEndpoint"`
-	Weight                  int    `json:"weight"`
+	Addr                    string          `json:"addr"`
+	HealthCheckHTTPEndpoint string          `json:"healthCheckHTTPEndpoint"`
+	Weight                  int             `json:"weight"`
+	HealthCheck             *HealthCheck    `json:"healthCheck"`
+	TLS                     *ClientTLS      `json:"tls"`
+	CircuitBreaker          *CircuitBreaker `json:"circuitBreaker"`
+}
+
+// per server active health check settings, times are in seconds
+// type is "http" | "tcp" | "grpc", defaults to the load balancer protocol.
+// method, path, headers, expectedStatuses and body matching apply to http checks,
+// script to tcp checks, service to grpc checks, tls defaults to the server's tls
+type HealthCheck struct {
+	Type             string            `json:"type"`
+	Interval         int               `json:"interval"`
+	Timeout          int               `json:"timeout"`
+	Rise             int               `json:"rise"`
+	Fall             int               `json:"fall"`
+	Method           string            `json:"method"`
+	Path             string            `json:"path"`
+	Headers          map[string]string `json:"headers"`
+	ExpectedStatuses []string          `json:"expectedStatuses"`
+	BodyContains     string            `json:"bodyContains"`
+	BodyRegex        string            `json:"bodyRegex"`
+	Script           []HealthCheckStep `json:"script"`
+	Service          string            `json:"service"`
+	TLS              *ClientTLS        `json:"tls"`
+}
+
+// tcp health check step, sends send (if set) then waits for expect (if set)
+type HealthCheckStep struct {
+	Send   string `json:"send"`
+	Expect string `json:"expect"`
+}
+
+// tls termination settings for the load balancer listener,
+// certFile/keyFile is a shorthand for a single entry in certificates
+type ListenerTLS struct {
+	CertFile          string             `json:"certFile"`
+	KeyFile           string             `json:"keyFile"`
+	Certificates      []Certificate      `json:"certificates"`
+	MinVersion        string             `json:"minVersion"`
+	CipherSuites      []string           `json:"cipherSuites"`
+	ALPN              []string           `json:"alpn"`
+	ReloadInterval    int                `json:"reloadInterval"`
+	ClientAuth        string             `json:"clientAuth"`
+	ClientCAFile      string             `json:"clientCAFile"`
+	ClientCertHeaders *ClientCertHeaders `json:"clientCertHeaders"`
+}
+
+// http and grpc modes, header names the verified client certificate is forwarded in
+type ClientCertHeaders struct {
+	Subject     string `json:"subject"`
+	SANs        string `json:"sans"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type Certificate struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+}
+
+// tls settings for connections made to backends,
+// certFile/keyFile is the client certificate for mutual tls
+type ClientTLS struct {
+	CAFile             string `json:"caFile"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	CertFile           string `json:"certFile"`
+	KeyFile            string `json:"keyFile"`
 }
 
 func LoadConfig() *Config {
@@ -0,0 +1,174 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// grpc.health.v1.HealthCheckResponse.ServingStatus values
+const (
+	grpcStatusUnknown        = 0
+	grpcStatusServing        = 1
+	grpcStatusNotServing     = 2
+	grpcStatusServiceUnknown = 3
+)
+
+// GRPCCheck probes a server with the grpc health checking protocol
+// (grpc.health.v1.Health/Check) over http/2, cleartext unless TLS is set
+type GRPCCheck struct {
+	// service name sent in the request, empty checks the server's overall health
+	Service string
+	client  *http.Client
+	scheme  string
+}
+
+func NewGRPCCheck(service string, tlsConfig *tls.Config) *GRPCCheck {
+	var protocols http.Protocols
+	scheme := "http"
+	transport := &http.Transport{}
+	if tlsConfig != nil {
+		scheme = "https"
+		protocols.SetHTTP2(true)
+		transport.TLSClientConfig = tlsConfig
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = &protocols
+	return &GRPCCheck{
+		Service: service,
+		client:  &http.Client{Transport: transport},
+		scheme:  scheme,
+	}
+}
+
+func (c *GRPCCheck) Check(ctx context.Context, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.scheme+"://"+addr+"/grpc.health.v1.Health/Check",
+		bytes.NewReader(grpcFrame(encodeHealthCheckRequest(c.Service))))
+	if err != nil {
+		return fmt.Errorf("invalid grpc health check request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+	// trailers only response, the call failed without a message
+	if status := resp.Header.Get("Grpc-Status"); status != "" && status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Header.Get("Grpc-Message"))
+	}
+
+	msg, err := readGRPCFrame(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading grpc health check response: %w", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if status := resp.Trailer.Get("Grpc-Status"); status != "" && status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	switch status := decodeHealthCheckResponse(msg); status {
+	case grpcStatusServing:
+		return nil
+	case grpcStatusNotServing:
+		return errors.New("service not serving")
+	case grpcStatusServiceUnknown:
+		return fmt.Errorf("service %q unknown", c.Service)
+	default:
+		return fmt.Errorf("unknown serving status %d", status)
+	}
+}
+
+// prefixes a message with the grpc length prefixed message header
+// (1 byte compressed flag, 4 bytes big endian length)
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// reads one uncompressed length prefixed grpc message
+func readGRPCFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed grpc messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxBodyBytes {
+		return nil, fmt.Errorf("grpc message too large (%d bytes)", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// protobuf encoding of HealthCheckRequest { string service = 1; }
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return []byte{}
+	}
+	msg := []byte{0x0a} // field 1, wire type 2 (length delimited)
+	msg = binary.AppendUvarint(msg, uint64(len(service)))
+	return append(msg, service...)
+}
+
+// decodes HealthCheckResponse { ServingStatus status = 1; },
+// unknown fields are skipped
+func decodeHealthCheckResponse(msg []byte) uint64 {
+	status := uint64(grpcStatusUnknown)
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return grpcStatusUnknown
+		}
+		msg = msg[n:]
+		switch tag & 0x7 {
+		case 0: // varint
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return grpcStatusUnknown
+			}
+			if tag>>3 == 1 {
+				status = v
+			}
+			msg = msg[n:]
+		case 1: // 64 bit
+			if len(msg) < 8 {
+				return grpcStatusUnknown
+			}
+			msg = msg[8:]
+		case 2: // length delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return grpcStatusUnknown
+			}
+			msg = msg[n+int(l):]
+		case 5: // 32 bit
+			if len(msg) < 4 {
+				return grpcStatusUnknown
+			}
+			msg = msg[4:]
+		default:
+			return grpcStatusUnknown
+		}
+	}
+	return status
+}
@@ -0,0 +1,103 @@
+// health contains the active health check probes and their scheduling settings
+package health
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// default per probe timeout
+const DefaultTimeout = 5 * time.Second
+
+// Config holds a server's health check scheduling and threshold settings
+type Config struct {
+	// overrides the load balancer's health check interval when > 0
+	Interval time.Duration
+	// timeout for a single probe
+	Timeout time.Duration
+	// consecutive successful probes before an unhealthy server is healthy again
+	Rise int
+	// consecutive failed probes before a healthy server is unhealthy
+	Fall int
+}
+
+// returns the config with defaults filled for unset values
+func (c Config) WithDefaults() Config {
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.Rise <= 0 {
+		c.Rise = 1
+	}
+	if c.Fall <= 0 {
+		c.Fall = 1
+	}
+	return c
+}
+
+// Status applies rise/fall thresholds to probe results,
+// servers start as healthy
+type Status struct {
+	rise      int
+	fall      int
+	healthy   bool
+	successes int
+	failures  int
+	mu        *sync.Mutex
+}
+
+func NewStatus(rise, fall int) *Status {
+	return &Status{
+		rise:    max(rise, 1),
+		fall:    max(fall, 1),
+		healthy: true,
+		mu:      &sync.Mutex{},
+	}
+}
+
+// records a probe result and returns the resulting health state
+func (s *Status) Record(ok bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok {
+		s.successes++
+		s.failures = 0
+		if !s.healthy && s.successes >= s.rise {
+			s.healthy = true
+		}
+	} else {
+		s.failures++
+		s.successes = 0
+		if s.healthy && s.failures >= s.fall {
+			s.healthy = false
+		}
+	}
+	return s.healthy
+}
+
+// returns a random duration in [0, d), used to spread the first probes
+// of all servers over an interval
+func InitialDelay(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// returns d randomly adjusted by up to ±10% so periodic probes of
+// different servers drift apart instead of firing at the same instant
+func Jitter(d time.Duration) time.Duration {
+	spread := d / 10
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + rand.N(2*spread)
+}
+
+// Checker runs a single health probe against addr (host:port),
+// returns nil when the server is healthy
+type Checker interface {
+	Check(ctx context.Context, addr string) error
+}
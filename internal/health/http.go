@@ -0,0 +1,133 @@
+package health
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// max response body bytes read for body matching
+const maxBodyBytes = 64 * 1024
+
+// HTTPCheck probes a server with an http request and validates the response
+type HTTPCheck struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+	// accepted status codes, defaults to 200-299
+	ExpectedStatuses []StatusRange
+	// optional substring the response body must contain
+	BodyContains string
+	// optional regular expression the response body must match
+	BodyRegex *regexp.Regexp
+	// client used for probes, http.DefaultClient when nil
+	Client *http.Client
+	// when set the probe is sent over https with this config
+	TLS *tls.Config
+}
+
+// inclusive range of http status codes
+type StatusRange struct {
+	From int
+	To   int
+}
+
+// parses status ranges like "200", "200-299"
+func ParseStatusRanges(values []string) ([]StatusRange, error) {
+	ranges := make([]StatusRange, 0, len(values))
+	for _, value := range values {
+		fromStr, toStr, isRange := strings.Cut(strings.TrimSpace(value), "-")
+		from, err := strconv.Atoi(strings.TrimSpace(fromStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status range %q", value)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(strings.TrimSpace(toStr)); err != nil || to < from {
+				return nil, fmt.Errorf("invalid status range %q", value)
+			}
+		}
+		ranges = append(ranges, StatusRange{From: from, To: to})
+	}
+	return ranges, nil
+}
+
+// sends the health check request to addr, returns nil when the response
+// matches the expectations
+func (c *HTTPCheck) Check(ctx context.Context, addr string) error {
+	method := c.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := c.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	scheme := "http"
+	if c.TLS != nil {
+		scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+addr+path, nil)
+	if err != nil {
+		return fmt.Errorf("invalid health check request: %w", err)
+	}
+	for key, val := range c.Headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = val
+			continue
+		}
+		req.Header.Set(key, val)
+	}
+
+	client := c.Client
+	if client == nil && c.TLS != nil {
+		// fresh connection per probe, so the handshake is checked too
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: c.TLS, DisableKeepAlives: true}}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !c.statusExpected(resp.StatusCode) {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodyBytes))
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if c.BodyContains == "" && c.BodyRegex == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodyBytes))
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return fmt.Errorf("error reading health check response: %w", err)
+	}
+	if c.BodyContains != "" && !strings.Contains(string(body), c.BodyContains) {
+		return fmt.Errorf("response body doesn't contain %q", c.BodyContains)
+	}
+	if c.BodyRegex != nil && !c.BodyRegex.Match(body) {
+		return fmt.Errorf("response body doesn't match %q", c.BodyRegex.String())
+	}
+	return nil
+}
+
+func (c *HTTPCheck) statusExpected(status int) bool {
+	if len(c.ExpectedStatuses) == 0 {
+		return status >= 200 && status <= 299
+	}
+	for _, r := range c.ExpectedStatuses {
+		if status >= r.From && status <= r.To {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// max bytes buffered while waiting for an expected response
+const maxExpectBytes = 64 * 1024
+
+// TCPCheck probes a server by connecting to it and optionally running a
+// send/expect script, e.g. send "PING\r\n" and expect "+PONG"
+type TCPCheck struct {
+	Steps []TCPStep
+	// when set the probe connects over tls
+	TLS *tls.Config
+}
+
+// TCPStep sends Send (if any) and then waits until the data received
+// contains Expect (if any)
+type TCPStep struct {
+	Send   string
+	Expect string
+}
+
+// runs the check against addr, returns nil when every step succeeded
+func (c *TCPCheck) Check(ctx context.Context, addr string) error {
+	var conn net.Conn
+	var err error
+	if c.TLS != nil {
+		dialer := &tls.Dialer{Config: c.TLS}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var received []byte
+	buf := make([]byte, 4096)
+	for i, step := range c.Steps {
+		if step.Send != "" {
+			if _, err := conn.Write([]byte(step.Send)); err != nil {
+				return fmt.Errorf("step %d: error sending: %w", i+1, err)
+			}
+		}
+		if step.Expect == "" {
+			continue
+		}
+		for {
+			if idx := bytes.Index(received, []byte(step.Expect)); idx != -1 {
+				// following steps only look at data after the match
+				received = received[idx+len(step.Expect):]
+				break
+			}
+			if len(received) > maxExpectBytes {
+				return fmt.Errorf("step %d: expected %q not found", i+1, step.Expect)
+			}
+			n, err := conn.Read(buf)
+			received = append(received, buf[:n]...)
+			if err != nil && n == 0 {
+				return fmt.Errorf("step %d: expected %q, got %q: %w", i+1, step.Expect, received, err)
+			}
+		}
+	}
+	return nil
+}
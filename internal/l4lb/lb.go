@@ -1,61 +1,132 @@
 package l4lb
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/mohits-git/load-balancer/internal/breaker"
+	"github.com/mohits-git/load-balancer/internal/health"
+	"github.com/mohits-git/load-balancer/internal/outlier"
+	"github.com/mohits-git/load-balancer/internal/retry"
+	"github.com/mohits-git/load-balancer/internal/tunnel"
 	"github.com/mohits-git/load-balancer/internal/types"
 )
 
+// timeout for completing the tls handshake with clients
+const tlsHandshakeTimeout = 10 * time.Second
+
+// timeout for reading the tls ClientHello of connections routed by SNI
+const peekTimeout = 10 * time.Second
+
 // Layer 4 Load balancer, distributes tcp requests load to multiple backend servers
+// organized in pools, connections go to the default pool unless an SNI route matches
 type L4LoadBalancer struct {
-	servers             []*TCPServer
+	defaultPool         *pool
+	pools               map[string]*pool
+	sniRoutes           []sniRoute
 	listener            net.Listener
+	tlsConfig           *tls.Config
 	connWg              *sync.WaitGroup
-	algo                types.LoadBalancingAlgorithm
 	healthCheckInterval time.Duration
 	retryLimit          int
+	outlierConfig       *outlier.Config
+	backoff             retry.Backoff
+	retryBudget         *retry.Budget
 }
 
-// returns new l4 load balancer
+// returns new l4 load balancer, lbalgo balances the default pool
 func NewL4LoadBalancer(lbalgo types.LoadBalancingAlgorithm, healthCheckInterval time.Duration, retryLimit int) *L4LoadBalancer {
 	if healthCheckInterval <= 0 {
 		healthCheckInterval = 10 * time.Second
 	}
 	return &L4LoadBalancer{
-		servers:             []*TCPServer{},
+		defaultPool:         newPool("default", lbalgo, 0, 0),
+		pools:               map[string]*pool{},
+		sniRoutes:           []sniRoute{},
 		listener:            nil,
 		connWg:              &sync.WaitGroup{},
-		algo:                lbalgo,
 		healthCheckInterval: healthCheckInterval,
 		retryLimit:          retryLimit,
+		backoff:             retry.Backoff{}.WithDefaults(),
 	}
 }
 
-// adds a new tcp server with address as 'addr'
+// sets the backoff between connect retries
+func (lb *L4LoadBalancer) SetBackoff(backoff retry.Backoff) {
+	lb.backoff = backoff.WithDefaults()
+}
+
+// caps connect retries of all connections to the budget
+func (lb *L4LoadBalancer) SetRetryBudget(budget *retry.Budget) {
+	lb.retryBudget = budget
+}
+
+// adds a new tcp server with address as 'addr' to the default pool
 func (lb *L4LoadBalancer) AddServer(server *TCPServer) {
-	lb.algo.AddServer(server)
-	lb.servers = append(lb.servers, server)
+	lb.defaultPool.addServer(server)
+}
+
+// adds a named pool of servers balanced by lbalgo, healthCheckInterval
+// and retryLimit override the load balancer's when set
+func (lb *L4LoadBalancer) AddPool(name string, lbalgo types.LoadBalancingAlgorithm, healthCheckInterval time.Duration, retryLimit int) {
+	p := newPool(name, lbalgo, healthCheckInterval, retryLimit)
+	if lb.outlierConfig != nil {
+		p.enableOutlierDetection(*lb.outlierConfig)
+	}
+	lb.pools[name] = p
 }
 
-// uses load balancing algorithms to pick a server to forward next req to
-func (lb *L4LoadBalancer) pickServer() *TCPServer {
-	server := lb.algo.NextServer()
-	if server == nil {
-		return nil
+// adds a tcp server to the named pool
+func (lb *L4LoadBalancer) AddPoolServer(poolName string, server *TCPServer) error {
+	p, ok := lb.pools[poolName]
+	if !ok {
+		return fmt.Errorf("Unknown pool %q", poolName)
 	}
-	tcpServer, ok := server.(*TCPServer)
+	p.addServer(server)
+	return nil
+}
+
+// routes tls connections whose SNI matches one of serverNames (exact or
+// "*.example.com" wildcards) to the named pool. without tls termination the
+// ClientHello is peeked and the encrypted stream is passed through as is
+func (lb *L4LoadBalancer) AddSNIRoute(serverNames []string, poolName string) error {
+	p, ok := lb.pools[poolName]
 	if !ok {
-		return nil
+		return fmt.Errorf("Unknown pool %q", poolName)
 	}
-	return tcpServer
+	lb.sniRoutes = append(lb.sniRoutes, sniRoute{serverNames: serverNames, pool: p})
+	return nil
+}
+
+// enables passive health checking in every pool, servers failing to accept connections get ejected
+func (lb *L4LoadBalancer) EnableOutlierDetection(cfg outlier.Config) {
+	lb.outlierConfig = &cfg
+	for _, p := range lb.allPools() {
+		p.enableOutlierDetection(cfg)
+	}
+}
+
+// returns the default pool followed by the named pools
+func (lb *L4LoadBalancer) allPools() []*pool {
+	pools := []*pool{lb.defaultPool}
+	for _, p := range lb.pools {
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// enables tls termination, clients connect over tls and
+// the decrypted stream is forwarded to backends as plaintext
+func (lb *L4LoadBalancer) SetTLSConfig(tlsConfig *tls.Config) {
+	lb.tlsConfig = tlsConfig
 }
 
 // starts the load balancer tcp server
@@ -65,6 +136,9 @@ func (lb *L4LoadBalancer) Start(port int) error {
 	if err != nil {
 		return fmt.Errorf("Error starting a tcp server: %w", err)
 	}
+	if lb.tlsConfig != nil {
+		ln = tls.NewListener(ln, lb.tlsConfig)
+	}
 	lb.listener = ln
 
 	connChan := make(chan net.Conn, 100)
@@ -77,28 +151,48 @@ func (lb *L4LoadBalancer) Start(port int) error {
 	return nil
 }
 
-func (lb *L4LoadBalancer) handleHealthCheck(server types.Server) bool {
+func (lb *L4LoadBalancer) handleHealthCheck(p *pool, server types.Server) bool {
 	if !server.IsHealthy() {
 		server.SetActive(false)
-		lb.algo.RemoveServer(server)
+		p.algo.RemoveServer(server)
 		return false
 	}
 	if !server.IsActive() {
+		if p.outlierDetector != nil && !p.outlierDetector.TryReturn(server) {
+			return true // still ejected
+		}
 		server.SetActive(true)
-		lb.algo.AddServer(server)
+		p.algo.AddServer(server)
 	}
 	return true
 }
 
 func (lb *L4LoadBalancer) startHealthCheck() {
-	for {
-		<-time.After(lb.healthCheckInterval)
-		for _, server := range lb.servers {
-			go lb.handleHealthCheck(server)
+	for _, p := range lb.allPools() {
+		for _, server := range p.servers {
+			go lb.runHealthCheck(p, server)
 		}
 	}
 }
 
+// probes the server every health check interval (server's, pool's or the load
+// balancer's), the first probe is delayed randomly and intervals are jittered
+// so checks don't all fire at the same instant
+func (lb *L4LoadBalancer) runHealthCheck(p *pool, server *TCPServer) {
+	interval := server.GetHealthCheckInterval()
+	if interval <= 0 {
+		interval = p.healthCheckInterval
+	}
+	if interval <= 0 {
+		interval = lb.healthCheckInterval
+	}
+	<-time.After(health.InitialDelay(interval))
+	for {
+		lb.handleHealthCheck(p, server)
+		<-time.After(health.Jitter(interval))
+	}
+}
+
 func (lb *L4LoadBalancer) acceptConnections(connChan chan net.Conn) {
 	defer close(connChan)
 	for {
@@ -113,66 +207,117 @@ func (lb *L4LoadBalancer) acceptConnections(connChan chan net.Conn) {
 	}
 }
 
-func (lb *L4LoadBalancer) doRequestWithRetryAndBackoff(reqBuf []byte) []byte {
-	var resp []byte
-	var err error
-
-	retryLimit := lb.retryLimit
-	if retryLimit <= 0 {
-		retryLimit = len(lb.servers)
-	}
+// picks a backend server of the pool and dials it, retrying with backoff on connect failures
+// while the retry budget allows. returns nil server and conn when every attempt failed
+func (lb *L4LoadBalancer) dialWithRetryAndBackoff(p *pool, ctx *types.RequestContext) (*TCPServer, net.Conn) {
+	retryLimit := p.retries(lb.retryLimit)
+	lb.retryBudget.RecordRequest()
 	for i := range retryLimit + 1 {
-		// backoff
 		if i > 0 {
-			waitPeriod := time.Duration(int(math.Pow(2.0, float64(i-1)))) * time.Second
-			log.Printf("Retrying in %v seconds\n", waitPeriod.Seconds())
-			<-time.After(waitPeriod)
+			if !lb.retryBudget.TryRetry() {
+				log.Println("Retry budget exhausted, not retrying")
+				break
+			}
+			lb.backoff.Wait(context.Background(), i)
 		}
 
-		server := lb.pickServer()
+		server := p.pickServer(ctx)
 		if server == nil {
 			continue
 		}
 
-		resp, err = server.DoRequest(reqBuf)
+		conn, err := server.Dial()
 		if err != nil {
+			log.Println("Error connecting to the server", server.GetAddr(), err)
+			if p.outlierDetector != nil && !breaker.IsRejection(err) {
+				p.outlierDetector.ReportFailure(server, outlier.ErrorReason(err))
+			}
 			continue
 		}
-
-		if resp != nil {
-			break
+		if p.outlierDetector != nil {
+			p.outlierDetector.ReportSuccess(server)
 		}
+
+		return server, conn
 	}
 
-	return resp
+	return nil, nil
 }
 
 func (lb *L4LoadBalancer) handleConn(conn net.Conn) {
 	defer conn.Close()
 	defer lb.connWg.Done()
 
-	log.Printf("Got request from %s\n\n", conn.RemoteAddr().String())
+	log.Printf("Got connection from %s\n", conn.RemoteAddr().String())
 
-	reqBuf := make([]byte, 1024)
-	n, err := conn.Read(reqBuf)
-	if err != nil {
-		log.Println("Error reading request")
-		return
+	// finish the handshake before picking a backend so failed
+	// handshakes don't open backend connections
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Println("TLS handshake failed with", conn.RemoteAddr().String(), err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
 	}
-	fmt.Println(string(reqBuf[:n]))
 
-	resp := lb.doRequestWithRetryAndBackoff(reqBuf)
-	if resp == nil {
-		conn.Write([]byte("HTTP/1.1 500 Internal Server Error"))
+	p, clientConn := lb.routeConn(conn)
+	if clientConn == nil {
+		return
 	}
 
-	if _, err := conn.Write(resp); err != nil {
-		log.Println("Error while writing response to client")
+	server, serverConn := lb.dialWithRetryAndBackoff(p, newRequestContext(conn))
+	if serverConn == nil {
+		log.Println("Unable to connect to any backend server, closing connection from", conn.RemoteAddr().String())
 		return
 	}
+	defer serverConn.Close()
 
-	log.Printf("Replied client with response:\n\n")
-	fmt.Println(string(resp))
+	server.connections.Add(1)
+	defer server.connections.Add(-1)
+
+	log.Printf("Proxying %s <-> %s (pool %s)\n", conn.RemoteAddr().String(), server.GetAddr(), p.name)
+	sent, received := tunnel.Pipe(clientConn, serverConn)
+	log.Printf("Closed %s <-> %s (sent %d bytes, received %d bytes)\n", conn.RemoteAddr().String(), server.GetAddr(), sent, received)
+}
+
+// picks the pool for the connection, by SNI when routes are configured.
+// returns the connection to proxy, which replays any bytes read while
+// peeking the ClientHello, nil when the connection should be dropped
+func (lb *L4LoadBalancer) routeConn(conn net.Conn) (*pool, net.Conn) {
+	if len(lb.sniRoutes) == 0 {
+		return lb.defaultPool, conn
+	}
+
+	// tls terminated here, the handshake already carried the server name
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if p := matchSNIRoute(lb.sniRoutes, tlsConn.ConnectionState().ServerName); p != nil {
+			return p, conn
+		}
+		return lb.defaultPool, conn
+	}
+
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	serverName, replay, consumed, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && consumed == 0 {
+		// the client didn't send anything, server speaks first protocols (e.g. smtp)
+		return lb.defaultPool, conn
+	}
+	if errors.As(err, &netErr) {
+		log.Println("Error reading client hello from", conn.RemoteAddr().String(), err)
+		return nil, nil
+	}
+	if err != nil {
+		// not tls, the default pool gets the connection as is
+		return lb.defaultPool, tunnel.NewBufferedConn(conn, replay)
+	}
+	if p := matchSNIRoute(lb.sniRoutes, serverName); p != nil {
+		log.Printf("Routing %s by SNI %q to pool %s\n", conn.RemoteAddr().String(), serverName, p.name)
+		return p, tunnel.NewBufferedConn(conn, replay)
+	}
+	return lb.defaultPool, tunnel.NewBufferedConn(conn, replay)
 }
 
 func (lb *L4LoadBalancer) Stop() {
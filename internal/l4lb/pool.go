@@ -0,0 +1,77 @@
+package l4lb
+
+import (
+	"time"
+
+	"github.com/mohits-git/load-balancer/internal/outlier"
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// pool is a group of backend servers balanced by its own algorithm,
+// with its own health check interval and retry limit (0 uses the load balancer's)
+type pool struct {
+	name                string
+	servers             []*TCPServer
+	algo                types.LoadBalancingAlgorithm
+	outlierDetector     *outlier.Detector
+	healthCheckInterval time.Duration
+	retryLimit          int
+}
+
+func newPool(name string, algo types.LoadBalancingAlgorithm, healthCheckInterval time.Duration, retryLimit int) *pool {
+	return &pool{
+		name:                name,
+		servers:             []*TCPServer{},
+		algo:                algo,
+		healthCheckInterval: healthCheckInterval,
+		retryLimit:          retryLimit,
+	}
+}
+
+func (p *pool) addServer(server *TCPServer) {
+	if observer, ok := p.algo.(types.RequestObserver); ok {
+		server.SetObserver(observer)
+	}
+	p.algo.AddServer(server)
+	p.servers = append(p.servers, server)
+	if p.outlierDetector != nil {
+		p.outlierDetector.AddServer(server)
+	}
+}
+
+func (p *pool) enableOutlierDetection(cfg outlier.Config) {
+	p.outlierDetector = outlier.NewDetector(cfg, p.ejectServer)
+	for _, server := range p.servers {
+		p.outlierDetector.AddServer(server)
+	}
+}
+
+// takes the server out of load balancing until the health checker brings it back
+func (p *pool) ejectServer(server types.Server) {
+	server.SetActive(false)
+	p.algo.RemoveServer(server)
+}
+
+// uses load balancing algorithms to pick a server to forward next req to
+func (p *pool) pickServer(ctx *types.RequestContext) *TCPServer {
+	server := p.algo.NextServer(ctx)
+	if server == nil {
+		return nil
+	}
+	tcpServer, ok := server.(*TCPServer)
+	if !ok {
+		return nil
+	}
+	return tcpServer
+}
+
+// returns the number of attempts after the first one, defaults to one per server
+func (p *pool) retries(defaultLimit int) int {
+	if p.retryLimit > 0 {
+		return p.retryLimit
+	}
+	if defaultLimit > 0 {
+		return defaultLimit
+	}
+	return len(p.servers)
+}
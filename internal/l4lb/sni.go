@@ -0,0 +1,90 @@
+package l4lb
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// routes tls connections to a pool by the SNI server name
+type sniRoute struct {
+	// exact names ("a.example.com") or wildcards ("*.example.com", matches one label)
+	serverNames []string
+	pool        *pool
+}
+
+// returns the pool for the server name: exact matches first, then the most
+// specific wildcard, nil when no route matches
+func matchSNIRoute(routes []sniRoute, serverName string) *pool {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return nil
+	}
+	for _, route := range routes {
+		for _, name := range route.serverNames {
+			if strings.EqualFold(name, serverName) {
+				return route.pool
+			}
+		}
+	}
+
+	var match *pool
+	matchLen := 0
+	_, parent, found := strings.Cut(serverName, ".")
+	if !found {
+		return nil
+	}
+	for _, route := range routes {
+		for _, name := range route.serverNames {
+			suffix, ok := strings.CutPrefix(name, "*.")
+			if ok && strings.EqualFold(suffix, parent) && len(suffix) > matchLen {
+				match, matchLen = route.pool, len(suffix)
+			}
+		}
+	}
+	return match
+}
+
+// reads the tls ClientHello from the connection without terminating tls,
+// returns the SNI server name, a reader replaying the consumed bytes
+// followed by the rest of the connection and the number of consumed bytes
+func peekServerName(conn net.Conn) (string, io.Reader, int, error) {
+	peeked := &bytes.Buffer{}
+	var serverName string
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			// abort the handshake, only the hello was needed
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	consumed := peeked.Len()
+	replay := io.MultiReader(peeked, conn)
+	if !errors.Is(err, errHelloRead) {
+		return "", replay, consumed, err
+	}
+	return serverName, replay, consumed, nil
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// readOnlyConn lets crypto/tls parse a ClientHello from a reader,
+// writes fail so nothing is ever sent to the client
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr         { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr        { return nil }
+
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -1,46 +1,102 @@
 package l4lb
 
 import (
-	"io"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
 	"sync/atomic"
+	"time"
+
+	"github.com/mohits-git/load-balancer/internal/breaker"
+	"github.com/mohits-git/load-balancer/internal/health"
+	"github.com/mohits-git/load-balancer/internal/types"
 )
 
+// timeout for establishing a tcp connection with the backend server
+const dialTimeout = 10 * time.Second
+
 // TCPServer is types.Server implementation for TCP servers
 type TCPServer struct {
-	addr        string
-	active      bool
-	weight      int
-	connections atomic.Int32
+	addr         string
+	tlsConfig    *tls.Config
+	active       atomic.Bool
+	weight       int
+	connections  atomic.Int32
+	observer     types.RequestObserver
+	healthCheck  health.Checker
+	healthConfig health.Config
+	healthStatus *health.Status
+	breaker      *breaker.Breaker
 }
 
 func NewTCPServer(addr string) *TCPServer {
-	return &TCPServer{
-		addr:        addr,
-		active:      true,
-		weight:      1,
-		connections: atomic.Int32{},
+	healthConfig := health.Config{}.WithDefaults()
+	server := &TCPServer{
+		addr:         addr,
+		weight:       1,
+		connections:  atomic.Int32{},
+		healthCheck:  &health.TCPCheck{},
+		healthConfig: healthConfig,
+		healthStatus: health.NewStatus(healthConfig.Rise, healthConfig.Fall),
 	}
+	server.active.Store(true)
+	return server
 }
 
-// TCPServer.IsHealthy returns true if server is running
-// else return false if not running
-func (s *TCPServer) IsHealthy() bool {
-	conn, err := net.Dial("tcp", s.addr)
-	if err != nil || conn == nil {
+// enables tls to the backend, connections are re-encrypted with this config
+func (s *TCPServer) SetTLSConfig(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+}
+
+// guards the server with a circuit breaker, failed dials count as failures.
+// max connections caps the open connections to the backend
+func (s *TCPServer) SetCircuitBreaker(b *breaker.Breaker) {
+	s.breaker = b
+}
+
+// reports whether the circuit breaker lets connections through, always true without one
+func (s *TCPServer) IsAvailable() bool {
+	if s.breaker == nil {
+		return true
+	}
+	if limit := s.breaker.Config().MaxConnections; limit > 0 && s.GetConnectionsCount() >= limit {
 		return false
 	}
-	conn.Close()
-	return true
+	return s.breaker.Available()
+}
+
+// sets the health check probe and its thresholds
+func (s *TCPServer) SetHealthCheck(cfg health.Config, check health.Checker) {
+	s.healthConfig = cfg.WithDefaults()
+	s.healthStatus = health.NewStatus(s.healthConfig.Rise, s.healthConfig.Fall)
+	s.healthCheck = check
+}
+
+// returns the server's health check interval, 0 if not overridden
+func (s *TCPServer) GetHealthCheckInterval() time.Duration {
+	return s.healthConfig.Interval
+}
+
+// TCPServer.IsHealthy returns true if server is running and passes its
+// health check (connect and send/expect script by default), after applying rise/fall thresholds
+func (s *TCPServer) IsHealthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.healthConfig.Timeout)
+	defer cancel()
+	err := s.healthCheck.Check(ctx, s.addr)
+	if err != nil {
+		log.Println("Server health check failed", s.addr, err)
+	}
+	return s.healthStatus.Record(err == nil)
 }
 
 func (s *TCPServer) IsActive() bool {
-	return s.active
+	return s.active.Load()
 }
 
 func (s *TCPServer) SetActive(active bool) {
-	s.active = active
+	s.active.Store(active)
 }
 
 // return server's remote addr
@@ -63,29 +119,43 @@ func (s *TCPServer) GetConnectionsCount() int {
 	return int(s.connections.Load())
 }
 
-// TCPServer.DoRequest dial tcp connection with the server
-// writes request (reqBuf) to the connection
-// and reads and returns response returned from the server
-func (s *TCPServer) DoRequest(reqBuf []byte) ([]byte, error) {
-	serverConn, err := net.Dial("tcp", s.addr)
+// sets the observer that gets the connect latency and outcome of every dial
+func (s *TCPServer) SetObserver(observer types.RequestObserver) {
+	s.observer = observer
+}
 
-	if err != nil {
-		log.Println("Error connecting to the server")
-		return nil, err
+// TCPServer.Dial opens a new tcp connection with the backend server,
+// completing the tls handshake when tls is set.
+// the caller owns the returned connection and must close it
+func (s *TCPServer) Dial() (net.Conn, error) {
+	var generation uint64
+	if s.breaker != nil {
+		if limit := s.breaker.Config().MaxConnections; limit > 0 && s.GetConnectionsCount() >= limit {
+			return nil, fmt.Errorf("Connection to %s rejected: %w", s.addr, breaker.ErrTooManyConnections)
+		}
+		var err error
+		if generation, err = s.breaker.Allow(); err != nil {
+			return nil, fmt.Errorf("Connection to %s rejected: %w", s.addr, err)
+		}
 	}
-
-	if _, err := serverConn.Write(reqBuf); err != nil {
-		log.Println("Error while writing client request to the backend server", s.addr)
-		return nil, err
-
+	start := time.Now()
+	conn, err := s.dial()
+	if s.observer != nil {
+		s.observer.ObserveRequest(s, time.Since(start), err)
 	}
-
-	buf := make([]byte, 1024)
-	n, err := serverConn.Read(buf)
-	if err != nil && err != io.EOF {
-		log.Println("Error reading backend's response")
-		return nil, err
+	if s.breaker != nil {
+		s.breaker.Done(generation, err == nil)
 	}
+	return conn, err
+}
 
-	return buf[:n], nil
+func (s *TCPServer) dial() (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return net.DialTimeout("tcp", s.addr, dialTimeout)
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: dialTimeout},
+		Config:    s.tlsConfig,
+	}
+	return dialer.Dial("tcp", s.addr)
 }
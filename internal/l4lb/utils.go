@@ -0,0 +1,21 @@
+package l4lb
+
+import (
+	"net"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// builds the request context used by load balancing algorithms
+func newRequestContext(conn net.Conn) *types.RequestContext {
+	ip, port, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return &types.RequestContext{Protocol: "tcp"}
+	}
+	return &types.RequestContext{
+		Protocol:   "tcp",
+		ClientIP:   ip,
+		ClientPort: port,
+		LocalAddr:  conn.LocalAddr().String(),
+	}
+}
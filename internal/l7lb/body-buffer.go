@@ -0,0 +1,109 @@
+package l7lb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// default request body buffering limits
+const (
+	defaultBodyMemoryLimit = 64 * 1024
+	defaultBodyMaxSize     = 10 * 1024 * 1024
+)
+
+// returned when the client's body can't be read, the request never reached a backend
+var errClientBody = errors.New("Error reading request body")
+
+// bufferedBody keeps a request body so it can be replayed on retries, in memory
+// up to the memory limit and in a temp file after that. bodies larger than the
+// max size aren't replayable, the buffered part is sent followed by the rest
+type bufferedBody struct {
+	mem      []byte
+	file     *os.File
+	fileSize int64
+	// part of the body not buffered, nil when the whole body was buffered
+	rest io.ReadCloser
+}
+
+// reads the body into the buffer, up to maxSize bytes
+func bufferBody(body io.ReadCloser, memoryLimit, maxSize int64) (*bufferedBody, error) {
+	b := &bufferedBody{}
+	src := &readErrRecorder{r: body}
+	mem := &bytes.Buffer{}
+	n, err := io.Copy(mem, io.LimitReader(src, memoryLimit))
+	b.mem = mem.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errClientBody, err)
+	}
+	if n < memoryLimit {
+		body.Close()
+		return b, nil
+	}
+
+	b.file, err = os.CreateTemp("", "lb-body-*")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request body buffer file: %w", err)
+	}
+	n, err = io.Copy(b.file, io.LimitReader(src, maxSize-memoryLimit+1))
+	b.fileSize = n
+	if err != nil {
+		b.close()
+		if src.err != nil {
+			return nil, fmt.Errorf("%w: %w", errClientBody, err)
+		}
+		return nil, fmt.Errorf("Error buffering request body: %w", err)
+	}
+	if n > maxSize-memoryLimit {
+		b.rest = body
+		return b, nil
+	}
+	body.Close()
+	return b, nil
+}
+
+// reports whether the body can be sent more than once
+func (b *bufferedBody) replayable() bool {
+	return b.rest == nil
+}
+
+// returns a reader of the whole body from the start
+func (b *bufferedBody) reader() io.ReadCloser {
+	readers := []io.Reader{bytes.NewReader(b.mem)}
+	if b.file != nil {
+		readers = append(readers, io.NewSectionReader(b.file, 0, b.fileSize))
+	}
+	if b.rest != nil {
+		readers = append(readers, b.rest)
+	}
+	return io.NopCloser(io.MultiReader(readers...))
+}
+
+// removes the temp file and releases the unbuffered rest of the body
+func (b *bufferedBody) close() error {
+	var errs []error
+	if b.file != nil {
+		errs = append(errs, b.file.Close(), os.Remove(b.file.Name()))
+	}
+	if b.rest != nil {
+		errs = append(errs, b.rest.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// readErrRecorder keeps the error of reading the client's body, to tell it
+// apart from failures writing the buffer file
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
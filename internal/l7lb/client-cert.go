@@ -0,0 +1,79 @@
+package l7lb
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// header names the verified client certificate is forwarded to backends in
+type ClientCertHeaders struct {
+	// RFC 2253 subject distinguished name
+	Subject string
+	// subject alternative names, e.g. "DNS:api.internal, URI:spiffe://svc"
+	SANs string
+	// hex encoded sha-256 of the DER certificate
+	Fingerprint string
+}
+
+var defaultClientCertHeaders = ClientCertHeaders{
+	Subject:     "X-Client-Cert-Subject",
+	SANs:        "X-Client-Cert-SANs",
+	Fingerprint: "X-Client-Cert-Fingerprint",
+}
+
+// fills empty header names with the defaults
+func (h ClientCertHeaders) withDefaults() ClientCertHeaders {
+	if h.Subject == "" {
+		h.Subject = defaultClientCertHeaders.Subject
+	}
+	if h.SANs == "" {
+		h.SANs = defaultClientCertHeaders.SANs
+	}
+	if h.Fingerprint == "" {
+		h.Fingerprint = defaultClientCertHeaders.Fingerprint
+	}
+	return h
+}
+
+// replaces the client certificate headers of the request with the verified
+// certificate's details, values sent by the client are always dropped so they
+// can't be spoofed. returns false when a certificate is required but missing
+func (lb *L7LoadBalancer) setClientCertHeaders(r *http.Request) bool {
+	headers := lb.clientCertHeaders
+	r.Header.Del(headers.Subject)
+	r.Header.Del(headers.SANs)
+	r.Header.Del(headers.Fingerprint)
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return !lb.requireClientCert
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	r.Header.Set(headers.Subject, cert.Subject.String())
+	if sans := certSANs(cert); sans != "" {
+		r.Header.Set(headers.SANs, sans)
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set(headers.Fingerprint, hex.EncodeToString(fingerprint[:]))
+	return true
+}
+
+// returns the certificate's subject alternative names, comma separated
+func certSANs(cert *x509.Certificate) string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return strings.Join(sans, ", ")
+}
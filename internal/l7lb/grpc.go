@@ -0,0 +1,141 @@
+package l7lb
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpc status codes used by the load balancer
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// proxies a grpc call, every call is balanced on its own even when the
+// client multiplexes many of them on one http/2 connection.
+// failures are reported to the client as grpc status trailers
+func (lb *L7LoadBalancer) handleGRPCRequest(p *pool, w http.ResponseWriter, r *http.Request) {
+	resp := lb.doGRPCRequestWithRetryAndBackoff(p, r)
+	if resp == nil {
+		writeGRPCError(w, grpcUnavailable, "no backend available to handle the call")
+		return
+	}
+	defer resp.Body.Close()
+
+	// backend (or something in front of it) didn't answer with grpc
+	if resp.StatusCode != http.StatusOK {
+		writeGRPCError(w, grpcCodeFromHTTPStatus(resp.StatusCode), "backend responded with "+resp.Status)
+		return
+	}
+
+	if rw := rewriteFromRequest(r); rw != nil {
+		rw.applyResponse(resp)
+	}
+	if err := writeResponse(w, resp); err != nil {
+		log.Println("Error forwarding response to client", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// reports whether the backend answered with a trailers-only UNAVAILABLE response,
+// the only grpc failure the load balancer retries
+func isGRPCUnavailable(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Grpc-Status") == strconv.Itoa(grpcUnavailable)
+}
+
+// writes a trailers-only grpc response with the status code and message
+func writeGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// maps http status codes of non grpc responses to grpc codes,
+// as described in grpc's http-grpc-status-mapping
+func grpcCodeFromHTTPStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// percent encodes the grpc-message value, bytes outside printable ascii and '%' are encoded
+func encodeGRPCMessage(message string) string {
+	var sb strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// forwards the grpc call to a server of the pool, retrying with backoff on errors
+// and UNAVAILABLE responses. the call body is streamed to the backend while it's
+// buffered, calls are only retried while everything sent is still buffered
+// (up to the body memory limit), streaming calls aren't held back
+func (lb *L7LoadBalancer) doGRPCRequestWithRetryAndBackoff(p *pool, r *http.Request) *http.Response {
+	var resp *http.Response
+	ctx := newRequestContext(r)
+	retryLimit := p.retries(lb.retryLimit)
+	var body *teeBody
+	if r.ContentLength != 0 {
+		body = newTeeBody(r.Body, int(lb.bodyMemoryLimit))
+	}
+	for i := range retryLimit + 1 {
+		if i > 0 && !lb.waitBeforeRetry(r, i) {
+			break
+		}
+
+		server := p.pickServer(ctx)
+		if server == nil {
+			continue // retry
+		}
+
+		attempt := r
+		if body != nil {
+			attempt = withBody(r, body.reader())
+		}
+		var err error
+		resp, err = server.DoRequest(attempt)
+		p.reportOutcome(server, resp, err)
+		replayable := body == nil || body.replayable()
+		if err != nil {
+			if !replayable || !lb.canRetry(i, retryLimit) {
+				break
+			}
+			continue // retry
+		}
+
+		if isGRPCUnavailable(resp) && replayable && lb.canRetry(i, retryLimit) {
+			log.Println("Retrying UNAVAILABLE call from", server.GetAddr())
+			resp.Body.Close()
+			resp = nil
+			continue // retry
+		}
+		break
+	}
+
+	return resp
+}
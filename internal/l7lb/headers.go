@@ -0,0 +1,71 @@
+package l7lb
+
+import (
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hop-by-hop headers, meaningful only for a single connection (RFC 9110 section 7.6.1)
+// and not forwarded by proxies
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removes hop-by-hop headers and the headers listed in the Connection header
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// copies all header values from src to dst
+func copyHeader(dst, src http.Header) {
+	for key, vals := range src {
+		for _, val := range vals {
+			dst.Add(key, val)
+		}
+	}
+}
+
+// reports whether the TE header asks for trailers, the only TE value forwarded
+func acceptsTrailers(header http.Header) bool {
+	return headerHasToken(header, "Te", "trailers")
+}
+
+// copies the client request's end-to-end headers to the backend request headers
+// and sets the forwarding headers
+func setForwardedHeaders(dst http.Header, r *http.Request) {
+	clientIP, clientPort := GetHTTPClientRemoteAddrInfo(r)
+	copyHeader(dst, r.Header)
+	removeHopByHopHeaders(dst)
+	dst.Set("X-Forwarded-For", net.JoinHostPort(clientIP, clientPort))
+}
+
+// reports whether the comma separated header values contain token (case insensitive)
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for t := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package l7lb
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// HedgePolicy sends a copy of idempotent requests to a second server when the
+// first one hasn't responded within the hedge delay, the first response wins
+// and the other request is cancelled
+type HedgePolicy struct {
+	// percentile (0-100) of the first server's response times used as the hedge delay
+	Percentile float64
+	// bounds of the hedge delay, MaxDelay is used until the server has enough samples
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// fills unset values with the defaults: 95th percentile, at most 1s
+func (policy HedgePolicy) WithDefaults() HedgePolicy {
+	if policy.Percentile <= 0 || policy.Percentile > 100 {
+		policy.Percentile = 95
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = time.Second
+	}
+	policy.MinDelay = min(policy.MinDelay, policy.MaxDelay)
+	return policy
+}
+
+// returns how long to wait for the server before hedging
+func (policy *HedgePolicy) delay(server *HTTPServer) time.Duration {
+	delay, ok := server.LatencyPercentile(policy.Percentile)
+	if !ok {
+		return policy.MaxDelay
+	}
+	return min(max(delay, policy.MinDelay), policy.MaxDelay)
+}
+
+// outcome of one of the copies of a hedged request
+type hedgeResult struct {
+	index  int
+	server *HTTPServer
+	resp   *http.Response
+	err    error
+}
+
+// sends the request to server and, when it's slower than the hedge delay, to
+// another server of the pool. returns the server and response that came first,
+// or the last error when every copy failed, along with the servers whose copy
+// failed. the losing copy is cancelled
+func (lb *L7LoadBalancer) doHedgedRequest(p *pool, ctx *types.RequestContext, server *HTTPServer, policy *HedgePolicy, r *http.Request, body *bufferedBody, exclude []*HTTPServer) (*HTTPServer, *http.Response, []*HTTPServer, error) {
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	send := func(server *HTTPServer) {
+		reqCtx, cancel := context.WithCancel(r.Context())
+		cancels = append(cancels, cancel)
+		index := len(cancels) - 1
+		attempt := r.WithContext(reqCtx)
+		if body != nil {
+			attempt.Body = body.reader()
+		}
+		go func() {
+			resp, err := server.DoRequest(attempt)
+			results <- hedgeResult{index: index, server: server, resp: resp, err: err}
+		}()
+	}
+
+	send(server)
+	pending := 1
+	timer := time.NewTimer(policy.delay(server))
+	defer timer.Stop()
+	var res hedgeResult
+	var failed []*HTTPServer
+	for {
+		select {
+		case <-timer.C:
+			if hedge := lb.pickHedgeServer(p, ctx, server, exclude); hedge != nil {
+				log.Printf("Hedging request to %s, no response from %s yet\n", hedge.GetAddr(), server.GetAddr())
+				send(hedge)
+				pending++
+			}
+			continue
+		case res = <-results:
+			pending--
+		}
+		p.reportOutcome(res.server, res.resp, res.err)
+		if res.err == nil {
+			break
+		}
+		failed = append(failed, res.server)
+		// a failed copy waits for the other one
+		if pending == 0 {
+			break
+		}
+	}
+
+	for i, cancel := range cancels {
+		if i != res.index || res.err != nil {
+			cancel()
+		}
+	}
+	// the cancelled copy still has to be collected
+	go func() {
+		for range pending {
+			if loser := <-results; loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+		}
+	}()
+	if res.err != nil {
+		return res.server, nil, failed, res.err
+	}
+	// the winner's request context lives until its response is forwarded
+	res.resp.Body = &trackedBody{ReadCloser: res.resp.Body, done: cancels[res.index]}
+	return res.server, res.resp, failed, nil
+}
+
+// picks the server the hedge is sent to, nil when there is no other server
+// or the retry budget, which hedges are taken from, is exhausted
+func (lb *L7LoadBalancer) pickHedgeServer(p *pool, ctx *types.RequestContext, server *HTTPServer, exclude []*HTTPServer) *HTTPServer {
+	hedge := p.pickServerExcluding(ctx, append(slices.Clone(exclude), server))
+	if hedge == nil || hedge == server || slices.Contains(exclude, hedge) {
+		return nil
+	}
+	if !lb.retryBudget.TryRetry() {
+		log.Println("Retry budget exhausted, not hedging")
+		return nil
+	}
+	return hedge
+}
@@ -1,54 +1,141 @@
 package l7lb
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/mohits-git/load-balancer/internal/breaker"
+	"github.com/mohits-git/load-balancer/internal/health"
+	"github.com/mohits-git/load-balancer/internal/latency"
+	"github.com/mohits-git/load-balancer/internal/tunnel"
+	"github.com/mohits-git/load-balancer/internal/types"
 )
 
+// timeout for connecting to the backend and completing an upgrade handshake
+const upgradeTimeout = 30 * time.Second
+
 type HTTPServer struct {
-	addr                string
-	active              bool
-	healthCheckEndpoint string
-	weight              int
-	connections         atomic.Int32
-	client              http.Client
+	addr         string
+	scheme       string
+	tlsConfig    *tls.Config
+	active       atomic.Bool
+	weight       int
+	connections  atomic.Int32
+	client       http.Client
+	observer     types.RequestObserver
+	healthCheck  health.Checker
+	healthConfig health.Config
+	healthStatus *health.Status
+	breaker      *breaker.Breaker
+	latencies    *latency.Histogram
 }
 
 func NewHTTPServer(addr, healthCheckEndpoint string) *HTTPServer {
-	return &HTTPServer{
-		addr:                addr,
-		healthCheckEndpoint: healthCheckEndpoint,
-		active:              true,
-		weight:              1,
-		connections:         atomic.Int32{},
+	healthConfig := health.Config{}.WithDefaults()
+	server := &HTTPServer{
+		addr:         addr,
+		scheme:       "http",
+		weight:       1,
+		connections:  atomic.Int32{},
+		healthCheck:  &health.HTTPCheck{Path: healthCheckEndpoint},
+		healthConfig: healthConfig,
+		healthStatus: health.NewStatus(healthConfig.Rise, healthConfig.Fall),
+		latencies:    latency.NewHistogram(time.Minute),
 		client: http.Client{
 			Timeout: 60 * time.Second,
 			Transport: &http.Transport{
 				IdleConnTimeout:   90 * time.Second,
 				DisableKeepAlives: false,
+				// bodies are proxied as is, encoding is up to client and backend
+				DisableCompression: true,
+			},
+			// redirects are returned to the client instead of being followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
 			},
 		},
 	}
+	server.active.Store(true)
+	return server
 }
 
-func (s *HTTPServer) IsHealthy() bool {
-	reqUrl, err := url.JoinPath("http://", s.addr, s.healthCheckEndpoint)
-	if err != nil {
-		log.Println("Invalid address or health check endpoint", err)
-		return false
+// enables tls to the backend for proxied requests and upgrades,
+// must be set before the upstream protocol
+func (s *HTTPServer) SetTLSConfig(tlsConfig *tls.Config) {
+	s.tlsConfig = tlsConfig
+	s.client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	s.scheme = "https"
+}
+
+// sets the protocol used to talk to the backend:
+// "http1" (default, over tls when tls is set) | "h2c" (cleartext http/2 with prior knowledge) | "h2" (http/2 over tls, tls must be set)
+func (s *HTTPServer) SetUpstreamProtocol(protocol string) error {
+	var protocols http.Protocols
+	switch protocol {
+	case "", "http1":
+		protocols.SetHTTP1(true)
+	case "h2c":
+		if s.tlsConfig != nil {
+			return fmt.Errorf("Upstream protocol h2c can't be used with tls, use h2")
+		}
+		protocols.SetUnencryptedHTTP2(true)
+	case "h2":
+		// upgrades and health checks need the tls config too
+		if s.tlsConfig == nil {
+			return fmt.Errorf("Upstream protocol h2 needs tls, set the server's tls")
+		}
+		protocols.SetHTTP2(true)
+	default:
+		return fmt.Errorf("Invalid upstream protocol %q", protocol)
 	}
-	resp, err := http.Get(reqUrl)
+	s.client.Transport.(*http.Transport).Protocols = &protocols
+	return nil
+}
+
+// guards the server with a circuit breaker, 5xx responses and errors count as
+// failures. max connections caps the transport's connections to the backend
+func (s *HTTPServer) SetCircuitBreaker(b *breaker.Breaker) {
+	s.breaker = b
+	s.client.Transport.(*http.Transport).MaxConnsPerHost = b.Config().MaxConnections
+}
+
+// reports whether the circuit breaker lets requests through, always true without one
+func (s *HTTPServer) IsAvailable() bool {
+	return s.breaker == nil || s.breaker.Available()
+}
+
+// sets the health check probe and its thresholds
+func (s *HTTPServer) SetHealthCheck(cfg health.Config, check health.Checker) {
+	s.healthConfig = cfg.WithDefaults()
+	s.healthStatus = health.NewStatus(s.healthConfig.Rise, s.healthConfig.Fall)
+	s.healthCheck = check
+}
+
+// returns the server's health check interval, 0 if not overridden
+func (s *HTTPServer) GetHealthCheckInterval() time.Duration {
+	return s.healthConfig.Interval
+}
+
+// probes the server and returns its health after applying rise/fall thresholds
+func (s *HTTPServer) IsHealthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.healthConfig.Timeout)
+	defer cancel()
+	err := s.healthCheck.Check(ctx, s.addr)
 	if err != nil {
-		log.Println("Server found to be not healthy", s.addr, s.healthCheckEndpoint)
-		return false
+		log.Println("Server health check failed", s.addr, err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Println("Server found to be not healthy", s.addr, s.healthCheckEndpoint)
+	if !s.healthStatus.Record(err == nil) {
+		log.Println("Server found to be not healthy", s.addr)
 		return false
 	}
 	log.Printf("Server %s active", s.addr)
@@ -56,11 +143,11 @@ func (s *HTTPServer) IsHealthy() bool {
 }
 
 func (s *HTTPServer) IsActive() bool {
-	return s.active
+	return s.active.Load()
 }
 
 func (s *HTTPServer) SetActive(active bool) {
-	s.active = active
+	s.active.Store(active)
 }
 
 // returns server's remote addr
@@ -78,34 +165,114 @@ func (s *HTTPServer) SetWeight(weight int) {
 	s.weight = weight
 }
 
-// returns number of active connections to the server
+// returns number of active connections to the server, counted as in-flight
+// requests and upgraded tunnels. with http/2 upstreams many requests are
+// multiplexed on a single tcp connection and each of them counts
 func (s *HTTPServer) GetConnectionsCount() int {
 	return int(s.connections.Load())
 }
 
+// returns the p-th percentile (0-100) of the server's recent response times,
+// false until enough requests were made
+func (s *HTTPServer) LatencyPercentile(p float64) (time.Duration, bool) {
+	return s.latencies.Percentile(p)
+}
+
+// sets the observer that gets the latency and outcome of every request
+func (s *HTTPServer) SetObserver(observer types.RequestObserver) {
+	s.observer = observer
+}
+
 // forwards the request to the backend server
 // copys and build a new request
+// the request counts as an active connection (and a pending request of the
+// circuit breaker) until the response body is closed
 func (s *HTTPServer) DoRequest(r *http.Request) (*http.Response, error) {
-	clientIP, clientPort := GetHTTPClientRemoteAddrInfo(r)
+	generation, err := s.allow()
+	if err != nil {
+		return nil, fmt.Errorf("Request to %s rejected: %w", s.addr, err)
+	}
+	s.connections.Add(1)
+	start := time.Now()
+	resp, err := s.doRequest(r)
+	elapsed := time.Since(start)
+	if err != nil && r.Context().Err() != nil {
+		// requests cancelled by the client or by a faster hedge aren't the
+		// backend's failure and their time says nothing about its latency
+		s.connections.Add(-1)
+		s.release(generation)
+		return nil, err
+	}
+	if s.observer != nil {
+		s.observer.ObserveRequest(s, elapsed, err)
+	}
+	if err != nil {
+		s.connections.Add(-1)
+		s.recordOutcome(generation, false)
+		return nil, err
+	}
+	s.latencies.Record(elapsed)
+	success := resp.StatusCode < http.StatusInternalServerError
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: func() {
+		s.connections.Add(-1)
+		s.recordOutcome(generation, success)
+	}}
+	return resp, nil
+}
 
-	reqUrl, err := url.JoinPath("http://", s.addr, r.URL.Path)
+// ends a request let through by the circuit breaker without an outcome
+func (s *HTTPServer) release(generation uint64) {
+	if s.breaker != nil {
+		s.breaker.Release(generation)
+	}
+}
+
+// asks the circuit breaker to let a request through, returns the generation
+// the outcome is recorded with
+func (s *HTTPServer) allow() (uint64, error) {
+	if s.breaker == nil {
+		return 0, nil
+	}
+	return s.breaker.Allow()
+}
+
+// reports the outcome of a request let through to the circuit breaker
+func (s *HTTPServer) recordOutcome(generation uint64, success bool) {
+	if s.breaker != nil {
+		s.breaker.Done(generation, success)
+	}
+}
+
+func (s *HTTPServer) doRequest(r *http.Request) (*http.Response, error) {
+	reqUrl, err := url.JoinPath(s.scheme+"://", s.addr, r.URL.Path)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid address or health check endpoint: %w", err)
 	}
-	reqUrlWithQuery := reqUrl + "?" + r.URL.RawQuery
+	if r.URL.RawQuery != "" {
+		reqUrl += "?" + r.URL.RawQuery
+	}
 
-	newReq, err := http.NewRequest(r.Method, reqUrlWithQuery, r.Body)
+	body := r.Body
+	if r.ContentLength == 0 {
+		body = http.NoBody
+	}
+	// cancelled when the client goes away
+	newReq, err := http.NewRequestWithContext(r.Context(), r.Method, reqUrl, body)
 	if err != nil {
 		return nil, err
 	}
+	newReq.ContentLength = r.ContentLength
+	// shares the map, values are filled in once the client body is read
+	newReq.Trailer = r.Trailer
 
-	for key, vals := range r.Header {
-		for _, val := range vals {
-			newReq.Header.Add(key, val)
-		}
+	setForwardedHeaders(newReq.Header, r)
+	if acceptsTrailers(r.Header) {
+		newReq.Header.Set("Te", "trailers")
 	}
 	newReq.Header.Set("Host", s.addr)
-	newReq.Header.Set("X-Forwarded-For", net.JoinHostPort(clientIP, clientPort))
+	if rw := rewriteFromRequest(r); rw != nil {
+		rw.applyRequest(newReq)
+	}
 
 	resp, err := s.client.Do(newReq)
 	if err != nil {
@@ -115,3 +282,95 @@ func (s *HTTPServer) DoRequest(r *http.Request) (*http.Response, error) {
 
 	return resp, nil
 }
+
+// opens a connection to the backend and replays the client's upgrade handshake
+// (e.g. websocket), returns the backend's handshake response and the connection.
+// the caller owns the connection, after a 101 Switching Protocols response it
+// carries the upgraded protocol
+func (s *HTTPServer) DoUpgrade(r *http.Request) (*http.Response, net.Conn, error) {
+	generation, err := s.allow()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Upgrade to %s rejected: %w", s.addr, err)
+	}
+	start := time.Now()
+	resp, conn, err := s.doUpgrade(r)
+	if err != nil && r.Context().Err() != nil {
+		// cancelled by the client
+		s.release(generation)
+		return nil, nil, err
+	}
+	if s.observer != nil {
+		s.observer.ObserveRequest(s, time.Since(start), err)
+	}
+	// the handshake is the request, the tunnel isn't pending
+	s.recordOutcome(generation, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, conn, err
+}
+
+func (s *HTTPServer) doUpgrade(r *http.Request) (*http.Response, net.Conn, error) {
+	conn, err := s.dialUpgrade()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reqUrl := *r.URL
+	reqUrl.Scheme, reqUrl.Host = "", ""
+	newReq := &http.Request{
+		Method:     r.Method,
+		URL:        &reqUrl,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       s.addr,
+		Header:     make(http.Header),
+	}
+	setForwardedHeaders(newReq.Header, r)
+	newReq.Header.Set("Connection", "Upgrade")
+	newReq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	if rw := rewriteFromRequest(r); rw != nil {
+		rw.applyRequest(newReq)
+	}
+
+	conn.SetDeadline(time.Now().Add(upgradeTimeout))
+	if err := newReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, newReq)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return resp, tunnel.NewBufferedConn(conn, br), nil
+}
+
+// opens the connection for an upgrade, over tls when configured.
+// upgrades are http/1.1 only so that's the only protocol offered with ALPN
+func (s *HTTPServer) dialUpgrade() (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return net.DialTimeout("tcp", s.addr, upgradeTimeout)
+	}
+	tlsConfig := s.tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: upgradeTimeout},
+		Config:    tlsConfig,
+	}
+	return dialer.Dial("tcp", s.addr)
+}
+
+// trackedBody calls done once when the response body is closed
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -1,25 +1,41 @@
 package l7lb
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/mohits-git/load-balancer/internal/health"
+	"github.com/mohits-git/load-balancer/internal/outlier"
+	"github.com/mohits-git/load-balancer/internal/retry"
 	"github.com/mohits-git/load-balancer/internal/types"
 )
 
+// Layer 7 Load balancer, distributes http requests to backend servers organized
+// in pools, requests go to the pool of the first matching route or the default pool
 type L7LoadBalancer struct {
-	servers             []*HTTPServer
-	algo                types.LoadBalancingAlgorithm
+	defaultPool         *pool
+	pools               map[string]*pool
+	routes              []route
+	tlsConfig           *tls.Config
 	wg                  *sync.WaitGroup
 	healthCheckInterval time.Duration
 	retryLimit          int
+	grpcMode            bool
+	outlierConfig       *outlier.Config
+	requireClientCert   bool
+	clientCertHeaders   ClientCertHeaders
+	retryPolicy         RetryPolicy
+	backoff             retry.Backoff
+	retryBudget         *retry.Budget
+	bodyMemoryLimit     int64
+	bodyMaxSize         int64
 }
 
 func NewL7LoadBalancer(lbalgo types.LoadBalancingAlgorithm, healthCheckInterval time.Duration, retryLimit int) *L7LoadBalancer {
@@ -27,27 +43,156 @@ func NewL7LoadBalancer(lbalgo types.LoadBalancingAlgorithm, healthCheckInterval
 		healthCheckInterval = 10 * time.Second
 	}
 	return &L7LoadBalancer{
-		servers:             []*HTTPServer{},
-		algo:                lbalgo,
+		defaultPool:         newPool("default", lbalgo, 0, 0),
+		pools:               map[string]*pool{},
+		routes:              []route{},
 		wg:                  &sync.WaitGroup{},
 		healthCheckInterval: healthCheckInterval,
 		retryLimit:          retryLimit,
+		clientCertHeaders:   defaultClientCertHeaders,
+		retryPolicy:         defaultRetryPolicy,
+		backoff:             retry.Backoff{}.WithDefaults(),
+		bodyMemoryLimit:     defaultBodyMemoryLimit,
+		bodyMaxSize:         defaultBodyMaxSize,
 	}
 }
 
+// adds a server to the default pool
 func (lb *L7LoadBalancer) AddServer(server *HTTPServer) {
-	lb.servers = append(lb.servers, server)
-	lb.algo.AddServer(server)
+	lb.defaultPool.addServer(server)
 }
 
+// adds a named pool of servers balanced by lbalgo, healthCheckInterval
+// and retryLimit override the load balancer's when set
+func (lb *L7LoadBalancer) AddPool(name string, lbalgo types.LoadBalancingAlgorithm, healthCheckInterval time.Duration, retryLimit int) {
+	p := newPool(name, lbalgo, healthCheckInterval, retryLimit)
+	if lb.outlierConfig != nil {
+		p.enableOutlierDetection(*lb.outlierConfig)
+	}
+	lb.pools[name] = p
+}
+
+// adds a server to the named pool
+func (lb *L7LoadBalancer) AddPoolServer(poolName string, server *HTTPServer) error {
+	p, ok := lb.pools[poolName]
+	if !ok {
+		return fmt.Errorf("Unknown pool %q", poolName)
+	}
+	p.addServer(server)
+	return nil
+}
+
+// sends requests matching the route to the named pool, routes with a redirect or
+// a direct response don't need a pool. routes are matched in the order they are added
+func (lb *L7LoadBalancer) AddRoute(rt Route, poolName string) error {
+	if rt.Redirect != nil || rt.DirectResponse != nil {
+		lb.routes = append(lb.routes, route{Route: rt})
+		return nil
+	}
+	p, ok := lb.pools[poolName]
+	if !ok {
+		return fmt.Errorf("Unknown pool %q", poolName)
+	}
+	lb.routes = append(lb.routes, route{Route: rt, pool: p})
+	return nil
+}
+
+// enables passive health checking in every pool, servers failing live traffic get ejected
+func (lb *L7LoadBalancer) EnableOutlierDetection(cfg outlier.Config) {
+	lb.outlierConfig = &cfg
+	for _, p := range lb.allPools() {
+		p.enableOutlierDetection(cfg)
+	}
+}
+
+// returns the default pool followed by the named pools
+func (lb *L7LoadBalancer) allPools() []*pool {
+	pools := []*pool{lb.defaultPool}
+	for _, p := range lb.pools {
+		pools = append(pools, p)
+	}
+	return pools
+}
+
+// sets the retry policy of requests whose route doesn't have one
+func (lb *L7LoadBalancer) SetRetryPolicy(policy RetryPolicy) {
+	lb.retryPolicy = policy
+}
+
+// sets the backoff between retries
+func (lb *L7LoadBalancer) SetBackoff(backoff retry.Backoff) {
+	lb.backoff = backoff.WithDefaults()
+}
+
+// caps retries of all requests to the budget
+func (lb *L7LoadBalancer) SetRetryBudget(budget *retry.Budget) {
+	lb.retryBudget = budget
+}
+
+// sets how much of a request body is buffered for retries, in memory up to
+// memoryLimit bytes and in a temp file up to maxSize bytes, 0 keeps the default.
+// larger bodies are streamed to the backend and not retried
+func (lb *L7LoadBalancer) SetBodyBufferLimits(memoryLimit, maxSize int64) {
+	if memoryLimit > 0 {
+		lb.bodyMemoryLimit = memoryLimit
+	}
+	if maxSize > 0 {
+		lb.bodyMaxSize = maxSize
+	}
+	lb.bodyMaxSize = max(lb.bodyMaxSize, lb.bodyMemoryLimit)
+}
+
+// enables grpc mode, calls are balanced one by one, failures are translated
+// into grpc status trailers and only UNAVAILABLE calls are retried
+func (lb *L7LoadBalancer) SetGRPCMode(enabled bool) {
+	lb.grpcMode = enabled
+}
+
+// enables tls termination on the listener. when client certificates are
+// required the handshake only verifies certificates that are sent, clients
+// without one get a 403 response instead of a failed handshake
+func (lb *L7LoadBalancer) SetTLSConfig(tlsConfig *tls.Config) {
+	if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		lb.requireClientCert = true
+	}
+	lb.tlsConfig = tlsConfig
+}
+
+// sets the header names the verified client certificate is forwarded in,
+// empty names keep the defaults
+func (lb *L7LoadBalancer) SetClientCertHeaders(headers ClientCertHeaders) {
+	lb.clientCertHeaders = headers.withDefaults()
+}
+
+// starts the load balancer http server, it serves http/1.1 and http/2
+// (negotiated with ALPN over tls, prior knowledge h2c over cleartext)
 func (lb *L7LoadBalancer) Start(port int) error {
 	go lb.startHealthCheck()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", HTTPRequestLogger(lb.handleNewRequests))
 
-	log.Println("Started load balancer on port 8080")
-	if err := http.ListenAndServe(":"+strconv.Itoa(port), mux); err != nil {
-		return fmt.Errorf("Error while starting the loadbalancer")
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{
+		Addr:      ":" + strconv.Itoa(port),
+		Handler:   mux,
+		Protocols: &protocols,
+		TLSConfig: lb.tlsConfig,
+	}
+
+	log.Printf("Started load balancer on port %d\n", port)
+	var err error
+	if lb.tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
+		return fmt.Errorf("Error while starting the loadbalancer: %w", err)
 	}
 
 	return nil
@@ -60,97 +205,131 @@ func (lb *L7LoadBalancer) Stop() {
 }
 
 func (lb *L7LoadBalancer) startHealthCheck() {
-	for {
-		<-time.After(lb.healthCheckInterval)
-		fmt.Println()
-		for _, server := range lb.servers {
-			go lb.handleHealthCheck(server)
+	for _, p := range lb.allPools() {
+		for _, server := range p.servers {
+			go lb.runHealthCheck(p, server)
 		}
 	}
 }
 
+// probes the server every health check interval (server's, pool's or the load
+// balancer's), the first probe is delayed randomly and intervals are jittered
+// so checks don't all fire at the same instant
+func (lb *L7LoadBalancer) runHealthCheck(p *pool, server *HTTPServer) {
+	interval := server.GetHealthCheckInterval()
+	if interval <= 0 {
+		interval = p.healthCheckInterval
+	}
+	if interval <= 0 {
+		interval = lb.healthCheckInterval
+	}
+	<-time.After(health.InitialDelay(interval))
+	for {
+		lb.handleHealthCheck(p, server)
+		<-time.After(health.Jitter(interval))
+	}
+}
+
 func (lb *L7LoadBalancer) handleNewRequests(w http.ResponseWriter, r *http.Request) {
 	lb.wg.Add(1)
 	defer lb.wg.Done()
-	resp := lb.doRequestWithRetryAndBackoff(r)
-	if resp == nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Internal Server Error unable to do request\n"))
+	if !lb.setClientCertHeaders(r) {
+		log.Println("Rejecting request without client certificate from", r.RemoteAddr)
+		if lb.grpcMode {
+			writeGRPCError(w, grpcUnauthenticated, "client certificate required")
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Forbidden client certificate required\n"))
 		return
 	}
-
-	// write resp headers
-	for k, v := range resp.Header {
-		for _, val := range v {
-			w.Header().Add(k, val)
+	p, rt := lb.routeRequest(r)
+	if rt != nil && rt.Redirect != nil {
+		writeRedirect(w, r, rt)
+		return
+	}
+	if rt != nil && rt.DirectResponse != nil {
+		writeDirectResponse(w, r, rt.DirectResponse)
+		return
+	}
+	if p == nil {
+		log.Println("No route matched request for", r.Host+r.URL.Path)
+		if lb.grpcMode {
+			writeGRPCError(w, grpcUnimplemented, "no route for the call")
+			return
 		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not Found no route matched the request\n"))
+		return
 	}
-
-	// write resp received from server
-	defer resp.Body.Close()
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	if rt != nil && rt.Rewrite != nil {
+		r = withRewrite(r, rt)
+	}
+	if p.breakersOpen() {
+		log.Println("Circuit breakers of every server open in pool", p.name)
+		if lb.grpcMode {
+			writeGRPCError(w, grpcUnavailable, "circuit breakers of every backend open")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service Unavailable circuit breakers of every backend open\n"))
+		return
+	}
+	if lb.grpcMode {
+		lb.retryBudget.RecordRequest()
+		lb.handleGRPCRequest(p, w, r)
+		return
+	}
+	if isUpgradeRequest(r) {
+		lb.retryBudget.RecordRequest()
+		lb.handleUpgrade(p, w, r)
+		return
+	}
+	policy := &lb.retryPolicy
+	var hedge *HedgePolicy
+	if rt != nil {
+		if rt.RetryPolicy != nil {
+			policy = rt.RetryPolicy
+		}
+		hedge = rt.HedgePolicy
+	}
+	resp, err := lb.doRequestWithRetryAndBackoff(p, policy, hedge, r)
+	if errors.Is(err, errClientBody) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Bad Request unable to read request body\n"))
+		return
+	}
+	if resp == nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Internal Server Error unable to forward response\n"))
+		w.Write([]byte("Internal Server Error unable to do request\n"))
 		return
 	}
-	log.Println("Replied with response")
-}
 
-func (lb *L7LoadBalancer) pickServer() *HTTPServer {
-	server := lb.algo.NextServer()
-	if server == nil {
-		return nil
+	defer resp.Body.Close()
+	if rw := rewriteFromRequest(r); rw != nil {
+		rw.applyResponse(resp)
 	}
-	httpServer, ok := server.(*HTTPServer)
-	if !ok {
-		return nil
+	if err := writeResponse(w, resp); err != nil {
+		log.Println("Error forwarding response to client", err)
+		// status is already sent, abort so the client sees a truncated response
+		panic(http.ErrAbortHandler)
 	}
-	return httpServer
+	log.Println("Replied with response")
 }
 
-func (lb *L7LoadBalancer) handleHealthCheck(server types.Server) bool {
+func (lb *L7LoadBalancer) handleHealthCheck(p *pool, server types.Server) bool {
 	if !server.IsHealthy() {
 		server.SetActive(false)
-		lb.algo.RemoveServer(server)
+		p.algo.RemoveServer(server)
 		return false
 	}
 	if !server.IsActive() {
+		if p.outlierDetector != nil && !p.outlierDetector.TryReturn(server) {
+			return true // still ejected
+		}
 		log.Printf("Adding Server %s Back\n", server.GetAddr())
 		server.SetActive(true)
-		lb.algo.AddServer(server)
+		p.algo.AddServer(server)
 	}
 	return true
 }
-
-func (lb *L7LoadBalancer) doRequestWithRetryAndBackoff(r *http.Request) *http.Response {
-	var resp *http.Response
-	var err error
-	retryLimit := lb.retryLimit
-	if retryLimit < 1 {
-		retryLimit = len(lb.servers)
-	}
-	for i := range retryLimit + 1 {
-		// backoff
-		if i > 0 {
-			waitPeriod := time.Duration(int(math.Pow(2.0, float64(i-1)))) * time.Second
-			log.Printf("Retrying in %v seconds\n", waitPeriod.Seconds())
-			<-time.After(waitPeriod)
-		}
-
-		server := lb.pickServer()
-		if server == nil {
-			continue // retry
-		}
-
-		resp, err = server.DoRequest(r)
-		if err != nil {
-			continue // retry
-		}
-
-		if resp != nil {
-			break
-		}
-	}
-
-	return resp
-}
@@ -0,0 +1,131 @@
+package l7lb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mohits-git/load-balancer/internal/breaker"
+	"github.com/mohits-git/load-balancer/internal/outlier"
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// pool is a group of backend servers balanced by its own algorithm,
+// with its own health check interval and retry limit (0 uses the load balancer's)
+type pool struct {
+	name                string
+	servers             []*HTTPServer
+	algo                types.LoadBalancingAlgorithm
+	outlierDetector     *outlier.Detector
+	healthCheckInterval time.Duration
+	retryLimit          int
+}
+
+func newPool(name string, algo types.LoadBalancingAlgorithm, healthCheckInterval time.Duration, retryLimit int) *pool {
+	return &pool{
+		name:                name,
+		servers:             []*HTTPServer{},
+		algo:                algo,
+		healthCheckInterval: healthCheckInterval,
+		retryLimit:          retryLimit,
+	}
+}
+
+func (p *pool) addServer(server *HTTPServer) {
+	if observer, ok := p.algo.(types.RequestObserver); ok {
+		server.SetObserver(observer)
+	}
+	p.servers = append(p.servers, server)
+	p.algo.AddServer(server)
+	if p.outlierDetector != nil {
+		p.outlierDetector.AddServer(server)
+	}
+}
+
+func (p *pool) enableOutlierDetection(cfg outlier.Config) {
+	p.outlierDetector = outlier.NewDetector(cfg, p.ejectServer)
+	for _, server := range p.servers {
+		p.outlierDetector.AddServer(server)
+	}
+}
+
+// takes the server out of load balancing until the health checker brings it back
+func (p *pool) ejectServer(server types.Server) {
+	server.SetActive(false)
+	p.algo.RemoveServer(server)
+}
+
+// uses load balancing algorithms to pick a server to forward next req to
+func (p *pool) pickServer(ctx *types.RequestContext) *HTTPServer {
+	server := p.algo.NextServer(ctx)
+	if server == nil {
+		return nil
+	}
+	httpServer, ok := server.(*HTTPServer)
+	if !ok {
+		return nil
+	}
+	return httpServer
+}
+
+// picks a server that isn't excluded, excluded servers are only returned
+// when every active server is excluded
+func (p *pool) pickServerExcluding(ctx *types.RequestContext, exclude []*HTTPServer) *HTTPServer {
+	server := p.pickServer(ctx)
+	if server == nil || !slices.Contains(exclude, server) {
+		return server
+	}
+	// the algorithm keeps picking excluded servers (e.g. hash based), take the first other one
+	for _, s := range p.servers {
+		if s.IsActive() && s.IsAvailable() && !slices.Contains(exclude, s) {
+			return s
+		}
+	}
+	return server
+}
+
+// reports whether the pool has active servers but the circuit breakers of all
+// of them reject requests, requests then fail fast instead of being retried
+func (p *pool) breakersOpen() bool {
+	active := false
+	for _, server := range p.servers {
+		if !server.IsActive() {
+			continue
+		}
+		if server.IsAvailable() {
+			return false
+		}
+		active = true
+	}
+	return active
+}
+
+// returns the number of attempts after the first one, defaults to one per server
+func (p *pool) retries(defaultLimit int) int {
+	if p.retryLimit > 0 {
+		return p.retryLimit
+	}
+	if defaultLimit > 0 {
+		return defaultLimit
+	}
+	return len(p.servers)
+}
+
+// reports the request outcome to the outlier detector, if enabled.
+// requests rejected by the circuit breaker didn't reach the server and requests
+// cancelled by the client aren't its failure, neither are reported
+func (p *pool) reportOutcome(server *HTTPServer, resp *http.Response, err error) {
+	if p.outlierDetector == nil || breaker.IsRejection(err) || errors.Is(err, context.Canceled) {
+		return
+	}
+	switch {
+	case err != nil:
+		p.outlierDetector.ReportFailure(server, outlier.ErrorReason(err))
+	case resp.StatusCode >= http.StatusInternalServerError:
+		p.outlierDetector.ReportFailure(server, resp.Status)
+	default:
+		p.outlierDetector.ReportSuccess(server)
+	}
+}
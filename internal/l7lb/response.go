@@ -0,0 +1,69 @@
+package l7lb
+
+import (
+	"io"
+	"mime"
+	"net/http"
+)
+
+// writes the backend response to the client: status code, end-to-end headers,
+// body and trailers. streamed responses (server-sent events and responses
+// without a known length) are flushed after every write.
+// headers are already sent when an error is returned
+func writeResponse(w http.ResponseWriter, resp *http.Response) error {
+	header := w.Header()
+	copyHeader(header, resp.Header)
+	removeHopByHopHeaders(header)
+
+	// announce trailers so they can be sent after the body
+	announced := make(map[string]bool, len(resp.Trailer))
+	for name := range resp.Trailer {
+		announced[name] = true
+		header.Add("Trailer", name)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	var dst io.Writer = w
+	if isStreamed(resp) {
+		dst = &flushWriter{w: w, rc: http.NewResponseController(w)}
+	}
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return err
+	}
+
+	// trailer values are only known once the body has been read
+	for name, vals := range resp.Trailer {
+		if !announced[name] {
+			name = http.TrailerPrefix + name
+		}
+		header[name] = vals
+	}
+	return nil
+}
+
+// reports whether the response should be flushed as it arrives
+func isStreamed(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// flushWriter flushes the response after every write
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && err != http.ErrNotSupported {
+		return n, err
+	}
+	return n, nil
+}
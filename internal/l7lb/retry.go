@@ -0,0 +1,229 @@
+package l7lb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mohits-git/load-balancer/internal/breaker"
+)
+
+// RetryPolicy decides which failed requests are retried. connect failures are
+// retried for every method since the request never reached the backend, other
+// conditions only for idempotent methods unless NonIdempotent is set
+type RetryPolicy struct {
+	ConnectFailure bool
+	// connection reset or closed while the request was in flight
+	Reset   bool
+	Timeout bool
+	// 5xx responses
+	ServerErrors bool
+	// specific response status codes
+	StatusCodes   []int
+	NonIdempotent bool
+	// retries after the first attempt, 0 uses the pool's retry limit
+	RetryLimit int
+}
+
+// retries transport errors of idempotent requests and connect failures of every request
+var defaultRetryPolicy = RetryPolicy{ConnectFailure: true, Reset: true, Timeout: true}
+
+// parses retry conditions: "connect-failure" | "reset" | "timeout" | "5xx" | status code
+func ParseRetryOn(conditions []string) (RetryPolicy, error) {
+	var policy RetryPolicy
+	for _, condition := range conditions {
+		switch condition = strings.ToLower(strings.TrimSpace(condition)); condition {
+		case "connect-failure":
+			policy.ConnectFailure = true
+		case "reset":
+			policy.Reset = true
+		case "timeout":
+			policy.Timeout = true
+		case "5xx":
+			policy.ServerErrors = true
+		default:
+			status, err := strconv.Atoi(condition)
+			if err != nil || status < 100 || status > 599 {
+				return RetryPolicy{}, fmt.Errorf("Invalid retry condition %q", condition)
+			}
+			policy.StatusCodes = append(policy.StatusCodes, status)
+		}
+	}
+	return policy, nil
+}
+
+// reports whether a request failing with err should be retried
+func (policy *RetryPolicy) retriesError(method string, err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return policy.ConnectFailure
+	}
+	// rejected by the server's circuit breaker, never sent
+	if breaker.IsRejection(err) {
+		return policy.ConnectFailure
+	}
+	if !policy.NonIdempotent && !isIdempotent(method) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return policy.Timeout
+	}
+	return policy.Reset
+}
+
+// reports whether a request answered with status should be retried
+func (policy *RetryPolicy) retriesStatus(method string, status int) bool {
+	if !policy.NonIdempotent && !isIdempotent(method) {
+		return false
+	}
+	if policy.ServerErrors && status >= http.StatusInternalServerError {
+		return true
+	}
+	return slices.Contains(policy.StatusCodes, status)
+}
+
+// methods safe to send more than once (RFC 9110 section 9.2.2)
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// forwards the request to a server of the pool, retrying with backoff as allowed
+// by the policy. the body is buffered so every attempt sends it in full, and
+// retries go to servers that haven't failed the request yet. idempotent requests
+// are hedged when hedge is set, a hedged request counts as one attempt.
+// returns the last response or nil when no attempt got one, the error is
+// errClientBody when the client's body couldn't be read
+func (lb *L7LoadBalancer) doRequestWithRetryAndBackoff(p *pool, policy *RetryPolicy, hedge *HedgePolicy, r *http.Request) (*http.Response, error) {
+	retryLimit := policy.RetryLimit
+	if retryLimit < 1 {
+		retryLimit = p.retries(lb.retryLimit)
+	}
+	if !isIdempotent(r.Method) {
+		hedge = nil
+	}
+
+	var body *bufferedBody
+	if (retryLimit > 0 || hedge != nil) && r.ContentLength != 0 {
+		var err error
+		body, err = bufferBody(r.Body, lb.bodyMemoryLimit, lb.bodyMaxSize)
+		if err != nil {
+			log.Println("Error buffering request body", err)
+			return nil, err
+		}
+		// too large to replay, sent once
+		if !body.replayable() {
+			retryLimit = 0
+			hedge = nil
+		}
+	}
+
+	// counted once the request is going to a backend
+	lb.retryBudget.RecordRequest()
+
+	resp := lb.doAttempts(p, policy, hedge, r, body, retryLimit)
+	if body == nil {
+		return resp, nil
+	}
+	if resp == nil {
+		body.close()
+		return nil, nil
+	}
+	// the transport may still be sending the body until the response is closed
+	resp.Body = &trackedBody{ReadCloser: resp.Body, done: func() { body.close() }}
+	return resp, nil
+}
+
+// sends the request up to retryLimit+1 times, returns the last response or nil
+// when no attempt got one
+func (lb *L7LoadBalancer) doAttempts(p *pool, policy *RetryPolicy, hedge *HedgePolicy, r *http.Request, body *bufferedBody, retryLimit int) *http.Response {
+	ctx := newRequestContext(r)
+	var failed []*HTTPServer
+	for i := range retryLimit + 1 {
+		if i > 0 && !lb.waitBeforeRetry(r, i) {
+			return nil
+		}
+
+		server := p.pickServerExcluding(ctx, failed)
+		if server == nil {
+			continue // retry
+		}
+
+		var resp *http.Response
+		var err error
+		// servers that failed this attempt, every copy of a hedged request
+		attemptFailed := []*HTTPServer{server}
+		if hedge != nil {
+			server, resp, attemptFailed, err = lb.doHedgedRequest(p, ctx, server, hedge, r, body, failed)
+		} else {
+			attempt := r
+			if body != nil {
+				attempt = withBody(r, body.reader())
+			}
+			resp, err = server.DoRequest(attempt)
+			p.reportOutcome(server, resp, err)
+		}
+		if err != nil {
+			if !policy.retriesError(r.Method, err) || !lb.canRetry(i, retryLimit) {
+				return nil
+			}
+			failed = append(failed, attemptFailed...)
+			continue // retry
+		}
+
+		if policy.retriesStatus(r.Method, resp.StatusCode) && lb.canRetry(i, retryLimit) {
+			log.Printf("Retrying %s response from %s\n", resp.Status, server.GetAddr())
+			// drained so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+			resp.Body.Close()
+			failed = append(failed, server)
+			continue // retry
+		}
+		return resp
+	}
+	return nil
+}
+
+// reports whether the attempt can be followed by a retry, the retry is
+// taken from the retry budget
+func (lb *L7LoadBalancer) canRetry(attempt, retryLimit int) bool {
+	if attempt >= retryLimit {
+		return false
+	}
+	if !lb.retryBudget.TryRetry() {
+		log.Println("Retry budget exhausted, not retrying")
+		return false
+	}
+	return true
+}
+
+// waits the backoff delay before the retry, returns false when the client
+// cancelled the request meanwhile
+func (lb *L7LoadBalancer) waitBeforeRetry(r *http.Request, retry int) bool {
+	if err := lb.backoff.Wait(r.Context(), retry); err != nil {
+		log.Println("Request cancelled while waiting to retry", err)
+		return false
+	}
+	return true
+}
+
+// max bytes of a discarded response read to reuse its connection
+const maxDrainBytes = 4096
+
+// returns a shallow copy of the request with the body replaced
+func withBody(r *http.Request, body io.ReadCloser) *http.Request {
+	attempt := new(http.Request)
+	*attempt = *r
+	attempt.Body = body
+	return attempt
+}
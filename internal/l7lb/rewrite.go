@@ -0,0 +1,137 @@
+package l7lb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// header carrying the request id, kept when the client sends one
+const requestIDHeader = "X-Request-Id"
+
+// Rewrite transforms requests matched by a route before they're sent to the
+// backend, and the backend's responses before they're sent to the client.
+// header and query values can use the templates ${client_ip}, ${request_id},
+// ${route}, ${host} and ${path} (the path before rewriting)
+type Rewrite struct {
+	// prefix removed from the path
+	StripPrefix string
+	// regular expression replaced in the path with PathReplacement ($1 expands groups)
+	PathRegex       *regexp.Regexp
+	PathReplacement string
+	// prefix added to the path, after stripping and regex replacement
+	AddPrefix       string
+	RequestHeaders  Edits
+	ResponseHeaders Edits
+	Query           Edits
+}
+
+// Edits removes, then sets and then appends values by name
+type Edits struct {
+	Set    map[string]string
+	Append map[string]string
+	Remove []string
+}
+
+func (e Edits) isEmpty() bool {
+	return len(e.Set) == 0 && len(e.Append) == 0 && len(e.Remove) == 0
+}
+
+func (e Edits) applyHeader(header http.Header, expand func(string) string) {
+	for _, name := range e.Remove {
+		header.Del(name)
+	}
+	for name, value := range e.Set {
+		header.Set(name, expand(value))
+	}
+	for name, value := range e.Append {
+		header.Add(name, expand(value))
+	}
+}
+
+// rewrite of a request, with the values its templates expand to
+type requestRewrite struct {
+	*Rewrite
+	expand func(string) string
+}
+
+type rewriteContextKey struct{}
+
+// returns the request carrying the route's rewrite, applied by HTTPServer.DoRequest
+// and HTTPServer.DoUpgrade to the backend request
+func withRewrite(r *http.Request, rt *Route) *http.Request {
+	clientIP, _ := GetHTTPClientRemoteAddrInfo(r)
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	replacer := strings.NewReplacer(
+		"${client_ip}", clientIP,
+		"${request_id}", requestID,
+		"${route}", rt.Name,
+		"${host}", r.Host,
+		"${path}", r.URL.Path,
+	)
+	rw := &requestRewrite{Rewrite: rt.Rewrite, expand: replacer.Replace}
+	return r.WithContext(context.WithValue(r.Context(), rewriteContextKey{}, rw))
+}
+
+// returns the request's rewrite, nil when its route has none
+func rewriteFromRequest(r *http.Request) *requestRewrite {
+	rw, _ := r.Context().Value(rewriteContextKey{}).(*requestRewrite)
+	return rw
+}
+
+// applies the path, query and header rewrites to the backend request
+func (rw *requestRewrite) applyRequest(backendReq *http.Request) {
+	path := backendReq.URL.Path
+	if rw.StripPrefix != "" {
+		path = strings.TrimPrefix(path, rw.StripPrefix)
+	}
+	if rw.PathRegex != nil {
+		path = rw.PathRegex.ReplaceAllString(path, rw.PathReplacement)
+	}
+	path = rw.AddPrefix + path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	backendReq.URL.Path = path
+	backendReq.URL.RawPath = ""
+
+	if !rw.Query.isEmpty() {
+		query := backendReq.URL.Query()
+		for _, name := range rw.Query.Remove {
+			query.Del(name)
+		}
+		for name, value := range rw.Query.Set {
+			query.Set(name, rw.expand(value))
+		}
+		for name, value := range rw.Query.Append {
+			query.Add(name, rw.expand(value))
+		}
+		backendReq.URL.RawQuery = query.Encode()
+	}
+
+	rw.RequestHeaders.applyHeader(backendReq.Header, rw.expand)
+	// the host isn't sent from the header map
+	for name, value := range rw.RequestHeaders.Set {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			backendReq.Host = rw.expand(value)
+		}
+	}
+}
+
+// applies the response header rewrites to the backend response
+func (rw *requestRewrite) applyResponse(resp *http.Response) {
+	rw.ResponseHeaders.applyHeader(resp.Header, rw.expand)
+}
+
+// returns a random 128 bit request id, hex encoded
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,94 @@
+package l7lb
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Redirect answers matched requests with a redirect to the request url with
+// the set parts replaced, e.g. Scheme "https" for http to https redirects
+type Redirect struct {
+	// 301 (default) | 302 | 303 | 307 | 308
+	StatusCode int
+	Scheme     string
+	// host, with port when needed
+	Host string
+	// replaces the port, 0 keeps the request's port unless the scheme changes
+	Port int
+	// replaces the whole path
+	Path string
+	// replaces the route's PathPrefix in the path
+	PrefixReplacement string
+	// drops the query string
+	StripQuery bool
+}
+
+// DirectResponse answers matched requests with a fixed response
+type DirectResponse struct {
+	// defaults to 200
+	StatusCode int
+	Headers    map[string]string
+	Body       []byte
+}
+
+// replies with the redirect to the url built from the request
+func writeRedirect(w http.ResponseWriter, r *http.Request, rt *Route) {
+	redirect := rt.Redirect
+	location := *r.URL
+	location.Scheme = "http"
+	if r.TLS != nil {
+		location.Scheme = "https"
+	}
+	location.Host = r.Host
+	// the request's port belongs to its scheme, e.g. http to https
+	// redirects must not send clients to the plaintext port
+	if redirect.Scheme != "" && redirect.Scheme != location.Scheme {
+		location.Host = stripPort(r.Host)
+	}
+	if redirect.Scheme != "" {
+		location.Scheme = redirect.Scheme
+	}
+	if redirect.Host != "" {
+		location.Host = redirect.Host
+	}
+	if redirect.Port != 0 {
+		location.Host = net.JoinHostPort(strings.Trim(stripPort(location.Host), "[]"), strconv.Itoa(redirect.Port))
+	}
+	switch {
+	case redirect.Path != "":
+		location.Path, location.RawPath = redirect.Path, ""
+	case rt.PathPrefix != "":
+		location.Path = redirect.PrefixReplacement + strings.TrimPrefix(r.URL.Path, rt.PathPrefix)
+		location.RawPath = ""
+	}
+	if redirect.StripQuery {
+		location.RawQuery = ""
+	}
+
+	status := redirect.StatusCode
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+	log.Printf("Redirecting %s to %s (%d)\n", r.URL.Path, location.String(), status)
+	w.Header().Set("Location", location.String())
+	w.WriteHeader(status)
+}
+
+// replies with the route's fixed response
+func writeDirectResponse(w http.ResponseWriter, r *http.Request, resp *DirectResponse) {
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(resp.Body)
+	}
+}
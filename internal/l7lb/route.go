@@ -0,0 +1,102 @@
+package l7lb
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Route matches requests to send to a pool, empty fields match everything
+type Route struct {
+	// name used in logs and rewrite templates
+	Name string
+	// exact host ("api.example.com") or wildcard ("*.example.com", matches one label), port ignored
+	Host string
+	// path has to start with the prefix
+	PathPrefix string
+	// path has to match the regular expression
+	PathRegex *regexp.Regexp
+	// one of the methods
+	Methods []string
+	// header name to exact value, an empty value only requires the header
+	Headers map[string]string
+	// optional request and response transformations
+	Rewrite *Rewrite
+	// retry policy of matched requests, defaults to the load balancer's
+	RetryPolicy *RetryPolicy
+	// hedging of matched idempotent requests, nil disables it
+	HedgePolicy *HedgePolicy
+	// when set, matched requests are answered by the load balancer without a backend
+	Redirect       *Redirect
+	DirectResponse *DirectResponse
+}
+
+type route struct {
+	Route
+	pool *pool
+}
+
+// reports whether the request matches every condition of the route
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Host != "" && !hostMatches(rt.Host, r.Host) {
+		return false
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.PathRegex != nil && !rt.PathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.Methods) > 0 && !slices.ContainsFunc(rt.Methods, func(method string) bool {
+		return strings.EqualFold(method, r.Method)
+	}) {
+		return false
+	}
+	for name, value := range rt.Headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 || (value != "" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matches the request host against an exact or "*.example.com" wildcard pattern
+func hostMatches(pattern, host string) bool {
+	host = strings.Trim(stripPort(host), "[]")
+	host = strings.TrimSuffix(host, ".")
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		_, parent, found := strings.Cut(host, ".")
+		return found && strings.EqualFold(parent, suffix)
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// returns the host without its port, ipv6 addresses keep their brackets
+func stripPort(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	if strings.Contains(h, ":") {
+		return "[" + h + "]"
+	}
+	return h
+}
+
+// returns the pool and the first matching route, the default pool and a nil
+// route when none match, nil pool when the default pool has no servers either
+// or the route is answered by the load balancer
+func (lb *L7LoadBalancer) routeRequest(r *http.Request) (*pool, *Route) {
+	for i := range lb.routes {
+		if lb.routes[i].matches(r) {
+			return lb.routes[i].pool, &lb.routes[i].Route
+		}
+	}
+	if len(lb.defaultPool.servers) == 0 {
+		return nil, nil
+	}
+	return lb.defaultPool, nil
+}
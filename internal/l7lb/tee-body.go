@@ -0,0 +1,115 @@
+package l7lb
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// returned to readers of attempts replaced by a newer one
+var errBodyReplayed = errors.New("Request body is read by a newer attempt")
+
+// teeBody streams a request body to the backend while keeping what was read so
+// far, so the request can be replayed as long as it's under the limit. the body
+// is only read when an attempt needs more of it, nothing is held back from the
+// backend. once more than the limit was read the buffer keeps only what the
+// reader hasn't consumed yet and the body can't be replayed anymore
+type teeBody struct {
+	body  io.ReadCloser
+	limit int
+	// serializes reads of body, a reader of an abandoned attempt may still be
+	// blocked in one, whatever it gets is kept for the next attempt
+	readMu *sync.Mutex
+	mu     *sync.Mutex
+	buf    []byte
+	// offset of buf[0] in the body, moves once over the limit
+	base     int
+	err      error
+	overflow bool
+	// readers of older attempts stop once a new reader is created
+	readers int
+}
+
+func newTeeBody(body io.ReadCloser, limit int) *teeBody {
+	return &teeBody{body: body, limit: limit, readMu: &sync.Mutex{}, mu: &sync.Mutex{}}
+}
+
+// reports whether everything read so far is still buffered
+func (t *teeBody) replayable() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.overflow
+}
+
+// returns a reader of the body from the start, closing it doesn't close the body
+func (t *teeBody) reader() io.ReadCloser {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.readers++
+	return io.NopCloser(&teeReader{tee: t, id: t.readers})
+}
+
+type teeReader struct {
+	tee    *teeBody
+	id     int
+	offset int
+}
+
+func (r *teeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	t := r.tee
+	for {
+		if n, ok, err := r.readBuffered(p); ok {
+			return n, err
+		}
+
+		t.readMu.Lock()
+		// another reader may have read more while this one waited
+		if n, ok, err := r.readBuffered(p); ok {
+			t.readMu.Unlock()
+			return n, err
+		}
+		chunk := make([]byte, len(p))
+		n, err := t.body.Read(chunk)
+		t.mu.Lock()
+		t.buf = append(t.buf, chunk[:n]...)
+		if err != nil {
+			t.err = err
+		}
+		if t.base+len(t.buf) > t.limit {
+			t.overflow = true
+		}
+		t.mu.Unlock()
+		t.readMu.Unlock()
+	}
+}
+
+// serves p from the buffer, ok is false when the reader has to wait for more of the body
+func (r *teeReader) readBuffered(p []byte) (int, bool, error) {
+	t := r.tee
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// what an abandoned attempt read from the body is kept for the newest one
+	if r.id != t.readers {
+		return 0, true, errBodyReplayed
+	}
+	if r.offset < t.base+len(t.buf) {
+		n := copy(p, t.buf[r.offset-t.base:])
+		r.offset += n
+		if t.overflow {
+			// can't be replayed anymore, drop what this reader consumed
+			t.buf = t.buf[r.offset-t.base:]
+			t.base = r.offset
+			if len(t.buf) == 0 {
+				t.buf = nil
+			}
+		}
+		return n, true, nil
+	}
+	if t.err != nil {
+		return 0, true, t.err
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,93 @@
+package l7lb
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/mohits-git/load-balancer/internal/tunnel"
+)
+
+// reports whether the client asks to switch protocols (e.g. websocket),
+// only possible over http/1.x
+func isUpgradeRequest(r *http.Request) bool {
+	return r.ProtoMajor == 1 &&
+		r.Header.Get("Upgrade") != "" &&
+		headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// tunnels an upgrade request: replays the handshake to a backend and, once it
+// switches protocols, pipes the hijacked client connection to it.
+// the tunnel counts as an active connection of the backend while it is open
+func (lb *L7LoadBalancer) handleUpgrade(p *pool, w http.ResponseWriter, r *http.Request) {
+	server, resp, backendConn := lb.doUpgradeWithRetryAndBackoff(p, r)
+	if resp == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error unable to do request\n"))
+		return
+	}
+	defer backendConn.Close()
+	defer resp.Body.Close()
+
+	if rw := rewriteFromRequest(r); rw != nil {
+		rw.applyResponse(resp)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// backend refused the upgrade, reply with its response
+		if err := writeResponse(w, resp); err != nil {
+			log.Println("Error forwarding response to client", err)
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	clientConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Println("Error hijacking client connection", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal Server Error unable to upgrade connection\n"))
+		return
+	}
+	defer clientConn.Close()
+
+	if err := resp.Write(clientConn); err != nil {
+		log.Println("Error forwarding upgrade response to client", err)
+		return
+	}
+
+	server.connections.Add(1)
+	defer server.connections.Add(-1)
+
+	log.Printf("Tunneling %s upgraded connection %s <-> %s\n", resp.Header.Get("Upgrade"), r.RemoteAddr, server.GetAddr())
+	sent, received := tunnel.Pipe(tunnel.NewBufferedConn(clientConn, brw.Reader), backendConn)
+	log.Printf("Closed %s <-> %s (sent %d bytes, received %d bytes)\n", r.RemoteAddr, server.GetAddr(), sent, received)
+}
+
+// picks a backend and replays the upgrade handshake, retrying with backoff
+// when connecting or the handshake fails
+func (lb *L7LoadBalancer) doUpgradeWithRetryAndBackoff(p *pool, r *http.Request) (*HTTPServer, *http.Response, net.Conn) {
+	ctx := newRequestContext(r)
+	retryLimit := p.retries(lb.retryLimit)
+	for i := range retryLimit + 1 {
+		if i > 0 && !lb.waitBeforeRetry(r, i) {
+			break
+		}
+
+		server := p.pickServer(ctx)
+		if server == nil {
+			continue // retry
+		}
+
+		resp, conn, err := server.DoUpgrade(r)
+		p.reportOutcome(server, resp, err)
+		if err != nil {
+			log.Println("Error doing upgrade request: ", err)
+			if !lb.canRetry(i, retryLimit) {
+				break
+			}
+			continue // retry
+		}
+		return server, resp, conn
+	}
+	return nil, nil, nil
+}
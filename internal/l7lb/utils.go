@@ -6,6 +6,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+
+	"github.com/mohits-git/load-balancer/internal/types"
 )
 
 // RequestLogger logs incoming clients requests with client addr info
@@ -45,3 +47,21 @@ func GetHTTPClientRemoteAddrInfo(r *http.Request) (string, string) {
 
 	return host, port
 }
+
+// builds the request context used by load balancing algorithms
+func newRequestContext(r *http.Request) *types.RequestContext {
+	ip, port := GetHTTPClientRemoteAddrInfo(r)
+	localAddr := ""
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr.String()
+	}
+	return &types.RequestContext{
+		Protocol:   "http",
+		ClientIP:   ip,
+		ClientPort: port,
+		LocalAddr:  localAddr,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Header:     r.Header,
+	}
+}
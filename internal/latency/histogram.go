@@ -0,0 +1,103 @@
+// latency keeps request latency distributions to estimate percentiles
+package latency
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// buckets grow by 10% from 100µs, the last one holds everything above ~1 minute
+const (
+	minLatency = 100 * time.Microsecond
+	growth     = 1.1
+	numBuckets = 141
+)
+
+// percentiles aren't estimated with fewer samples than this
+const minSamples = 20
+
+// Histogram counts latencies in exponential buckets over a rolling window,
+// percentiles are estimated from the current and the previous window
+type Histogram struct {
+	window    time.Duration
+	current   [numBuckets]int
+	previous  [numBuckets]int
+	rotatedAt time.Time
+	mu        *sync.Mutex
+}
+
+// returns an empty histogram, window defaults to a minute
+func NewHistogram(window time.Duration) *Histogram {
+	if window <= 0 {
+		window = time.Minute
+	}
+	return &Histogram{
+		window:    window,
+		rotatedAt: time.Now(),
+		mu:        &sync.Mutex{},
+	}
+}
+
+// records a latency sample
+func (h *Histogram) Record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rotate(time.Now())
+	h.current[bucket(d)]++
+}
+
+// returns the estimated p-th percentile (0-100) latency, false when there
+// aren't enough recent samples
+func (h *Histogram) Percentile(p float64) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rotate(time.Now())
+
+	total := 0
+	for i := range numBuckets {
+		total += h.current[i] + h.previous[i]
+	}
+	if total < minSamples {
+		return 0, false
+	}
+	rank := int(math.Ceil(min(max(p, 0), 100) / 100 * float64(total)))
+	seen := 0
+	for i := range numBuckets {
+		seen += h.current[i] + h.previous[i]
+		if seen >= rank {
+			return upperBound(i), true
+		}
+	}
+	return upperBound(numBuckets - 1), true
+}
+
+// moves the current window to the previous one once it's over, both are
+// dropped when nothing was recorded for two windows
+func (h *Histogram) rotate(now time.Time) {
+	elapsed := now.Sub(h.rotatedAt)
+	if elapsed < h.window {
+		return
+	}
+	if elapsed < 2*h.window {
+		h.previous = h.current
+	} else {
+		h.previous = [numBuckets]int{}
+	}
+	h.current = [numBuckets]int{}
+	h.rotatedAt = now
+}
+
+// returns the index of the bucket holding d
+func bucket(d time.Duration) int {
+	if d <= minLatency {
+		return 0
+	}
+	i := int(math.Ceil(math.Log(float64(d)/float64(minLatency)) / math.Log(growth)))
+	return min(i, numBuckets-1)
+}
+
+// returns the largest latency counted in the bucket
+func upperBound(i int) time.Duration {
+	return time.Duration(float64(minLatency) * math.Pow(growth, float64(i)))
+}
@@ -0,0 +1,116 @@
+package lbalgos
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// default number of ring points per unit of server weight
+const defaultVirtualNodes = 160
+
+// ConsistentHash is a ketama style consistent hash ring,
+// each server owns virtualNodes * weight points on the ring and a request
+// goes to the server owning the first point after the request's key hash.
+// adding or removing a server only moves the keys owned by that server
+type ConsistentHash struct {
+	servers      []types.Server
+	ring         []ringPoint
+	virtualNodes int
+	hashKey      func(*types.RequestContext) string
+	mu           *sync.RWMutex
+}
+
+type ringPoint struct {
+	hash   uint32
+	server types.Server
+}
+
+func NewConsistentHash(hashKey string, virtualNodes int) *ConsistentHash {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+	return &ConsistentHash{
+		servers:      []types.Server{},
+		ring:         []ringPoint{},
+		virtualNodes: virtualNodes,
+		hashKey:      hashKeyFunc(hashKey),
+		mu:           &sync.RWMutex{},
+	}
+}
+
+func (c *ConsistentHash) AddServer(server types.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := slices.IndexFunc(c.servers, isSameAddr(server)); i == -1 {
+		c.servers = append(c.servers, server)
+		c.buildRing()
+	}
+}
+
+func (c *ConsistentHash) RemoveServer(server types.Server) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := slices.IndexFunc(c.servers, isSameAddr(server)); i != -1 {
+		c.servers = slices.Delete(c.servers, i, i+1)
+		c.buildRing()
+	}
+}
+
+func (c *ConsistentHash) NextServer(ctx *types.RequestContext) types.Server {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.ring) == 0 {
+		return nil
+	}
+
+	h := ketamaHash(c.hashKey(ctx))
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	// unavailable servers are skipped, their keys go to the next server on the ring
+	for n := range len(c.ring) {
+		if server := c.ring[(i+n)%len(c.ring)].server; server.IsAvailable() {
+			return server
+		}
+	}
+	return nil
+}
+
+// rebuilds the ring from the current servers, caller must hold the write lock
+func (c *ConsistentHash) buildRing() {
+	ring := make([]ringPoint, 0, len(c.ring))
+	for _, server := range c.servers {
+		points := c.virtualNodes * positiveWeight(server)
+		// every md5 digest gives 4 ring points
+		for i := 0; i < (points+3)/4; i++ {
+			digest := md5.Sum([]byte(server.GetAddr() + "-" + strconv.Itoa(i)))
+			for j := range 4 {
+				ring = append(ring, ringPoint{
+					hash:   binary.LittleEndian.Uint32(digest[j*4:]),
+					server: server,
+				})
+			}
+		}
+	}
+	slices.SortFunc(ring, func(a, b ringPoint) int {
+		if a.hash < b.hash {
+			return -1
+		}
+		if a.hash > b.hash {
+			return 1
+		}
+		return 0
+	})
+	c.ring = ring
+}
+
+// hashes a key onto the ring, same as ketama's first 4 bytes of md5
+func ketamaHash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
@@ -0,0 +1,41 @@
+package lbalgos
+
+import (
+	"strings"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// returns a function extracting the hash key from the request context
+// supported sources: "client_ip" (default) | "host" | "path" | "header:<name>" | "cookie:<name>"
+// when the configured attribute is missing the client ip is used instead
+func hashKeyFunc(source string) func(*types.RequestContext) string {
+	var key func(*types.RequestContext) string
+	name, arg, _ := strings.Cut(source, ":")
+	switch strings.ToLower(name) {
+	case "host":
+		key = func(ctx *types.RequestContext) string { return ctx.Host }
+	case "path":
+		key = func(ctx *types.RequestContext) string { return ctx.Path }
+	case "header":
+		key = func(ctx *types.RequestContext) string {
+			if ctx.Header == nil {
+				return ""
+			}
+			return ctx.Header.Get(arg)
+		}
+	case "cookie":
+		key = func(ctx *types.RequestContext) string { return ctx.Cookie(arg) }
+	default:
+		key = func(ctx *types.RequestContext) string { return ctx.ClientIP }
+	}
+	return func(ctx *types.RequestContext) string {
+		if ctx == nil {
+			return ""
+		}
+		if k := key(ctx); k != "" {
+			return k
+		}
+		return ctx.ClientIP
+	}
+}
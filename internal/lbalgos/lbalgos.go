@@ -2,13 +2,33 @@ package lbalgos
 
 import "github.com/mohits-git/load-balancer/internal/types"
 
-func NewLoadBalancerAlgorithm(algoType string) types.LoadBalancingAlgorithm {
+// Options holds the settings used by algorithms that need more than the server list
+type Options struct {
+	// request attribute hashed by hash based algorithms, see hashKeyFunc
+	HashKey string
+	// consistent hash ring points per unit of server weight
+	VirtualNodes int
+	// maglev lookup table size, rounded up to a prime
+	MaglevTableSize int
+}
+
+func NewLoadBalancerAlgorithm(algoType string, opts Options) types.LoadBalancingAlgorithm {
 	var algo types.LoadBalancingAlgorithm
 	switch algoType {
 	case "Round Robin":
 		algo = NewRoundRobinAlgo()
 	case "Weighted Round Robin":
 		algo = NewWeightedRoundRobin()
+	case "Least Connections":
+		algo = NewLeastConnections()
+	case "Weighted Least Connections":
+		algo = NewWeightedLeastConnections()
+	case "Consistent Hash":
+		algo = NewConsistentHash(opts.HashKey, opts.VirtualNodes)
+	case "Maglev":
+		algo = NewMaglev(opts.MaglevTableSize)
+	case "P2C EWMA":
+		algo = NewP2CEWMA()
 	}
 	return algo
 }
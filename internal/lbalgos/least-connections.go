@@ -0,0 +1,65 @@
+package lbalgos
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// LeastConnections picks the server with the fewest in-flight connections,
+// ties are broken in round robin order so idle servers share the load
+type LeastConnections struct {
+	current int
+	servers []types.Server
+	mu      *sync.Mutex
+}
+
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{
+		current: 0,
+		servers: []types.Server{},
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (lc *LeastConnections) AddServer(server types.Server) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if i := slices.IndexFunc(lc.servers, isSameAddr(server)); i == -1 {
+		lc.servers = append(lc.servers, server)
+	}
+}
+
+func (lc *LeastConnections) RemoveServer(server types.Server) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.servers = slices.DeleteFunc(lc.servers, isSameAddr(server))
+}
+
+func (lc *LeastConnections) NextServer(ctx *types.RequestContext) types.Server {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if len(lc.servers) == 0 {
+		return nil
+	}
+
+	start := lc.current % len(lc.servers)
+	best, bestConns := -1, 0
+	for i := range len(lc.servers) {
+		idx := (start + i) % len(lc.servers)
+		if !lc.servers[idx].IsAvailable() {
+			continue
+		}
+		if conns := lc.servers[idx].GetConnectionsCount(); best == -1 || conns < bestConns {
+			best, bestConns = idx, conns
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+
+	lc.current = best + 1
+	return lc.servers[best]
+}
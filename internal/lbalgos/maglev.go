@@ -0,0 +1,160 @@
+package lbalgos
+
+import (
+	"hash/fnv"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// default maglev lookup table size, must be a prime
+const defaultMaglevTableSize = 65537
+
+// Maglev implements google's maglev hashing, connections are mapped by their
+// 5-tuple through a prime sized lookup table where every server owns a nearly
+// equal (weighted) share of entries. removing a server remaps the entries it
+// owned while almost every other connection keeps its backend.
+// the table is rebuilt on changes and swapped atomically so NextServer never blocks
+type Maglev struct {
+	servers   []types.Server
+	table     atomic.Pointer[[]types.Server]
+	tableSize int
+	mu        *sync.Mutex
+}
+
+func NewMaglev(tableSize int) *Maglev {
+	if tableSize <= 0 {
+		tableSize = defaultMaglevTableSize
+	}
+	m := &Maglev{
+		servers:   []types.Server{},
+		tableSize: nextPrime(tableSize),
+		mu:        &sync.Mutex{},
+	}
+	m.table.Store(&[]types.Server{})
+	return m
+}
+
+func (m *Maglev) AddServer(server types.Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := slices.IndexFunc(m.servers, isSameAddr(server)); i == -1 {
+		m.servers = append(m.servers, server)
+		m.buildTable()
+	}
+}
+
+func (m *Maglev) RemoveServer(server types.Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := slices.IndexFunc(m.servers, isSameAddr(server)); i != -1 {
+		m.servers = slices.Delete(m.servers, i, i+1)
+		m.buildTable()
+	}
+}
+
+func (m *Maglev) NextServer(ctx *types.RequestContext) types.Server {
+	table := *m.table.Load()
+	if len(table) == 0 {
+		return nil
+	}
+	// unavailable servers are skipped, their flows go to the next entries of the table
+	i := hash64(fiveTuple(ctx)) % uint64(len(table))
+	for n := range uint64(len(table)) {
+		if server := table[(i+n)%uint64(len(table))]; server.IsAvailable() {
+			return server
+		}
+	}
+	return nil
+}
+
+// builds a new lookup table from the current servers and publishes it,
+// caller must hold the mutex
+func (m *Maglev) buildTable() {
+	if len(m.servers) == 0 {
+		m.table.Store(&[]types.Server{})
+		return
+	}
+
+	// servers are sorted by address so the table doesn't depend on the order
+	// servers were added or brought back by health checks
+	servers := slices.Clone(m.servers)
+	slices.SortFunc(servers, func(a, b types.Server) int {
+		if a.GetAddr() < b.GetAddr() {
+			return -1
+		}
+		if a.GetAddr() > b.GetAddr() {
+			return 1
+		}
+		return 0
+	})
+
+	size := uint64(m.tableSize)
+	offsets := make([]uint64, len(servers))
+	skips := make([]uint64, len(servers))
+	next := make([]uint64, len(servers))
+	for i, server := range servers {
+		offsets[i] = hash64(server.GetAddr()+"#offset") % size
+		skips[i] = hash64(server.GetAddr()+"#skip")%(size-1) + 1
+	}
+
+	table := make([]types.Server, size)
+	filled := uint64(0)
+	for filled < size {
+		for i, server := range servers {
+			// weighted servers claim weight entries per round
+			for range positiveWeight(server) {
+				c := (offsets[i] + next[i]*skips[i]) % size
+				for table[c] != nil {
+					next[i]++
+					c = (offsets[i] + next[i]*skips[i]) % size
+				}
+				table[c] = server
+				next[i]++
+				filled++
+				if filled == size {
+					break
+				}
+			}
+			if filled == size {
+				break
+			}
+		}
+	}
+	m.table.Store(&table)
+}
+
+// connection's 5-tuple used as maglev key
+func fiveTuple(ctx *types.RequestContext) string {
+	if ctx == nil {
+		return ""
+	}
+	return ctx.Protocol + "|" + ctx.ClientIP + "|" + ctx.ClientPort + "|" + ctx.LocalAddr
+}
+
+func hash64(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// returns the smallest prime >= n
+func nextPrime(n int) int {
+	if n <= 2 {
+		return 2
+	}
+	for ; ; n++ {
+		prime := true
+		for d := 2; d*d <= n; d++ {
+			if n%d == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			return n
+		}
+	}
+}
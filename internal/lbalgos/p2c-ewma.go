@@ -0,0 +1,118 @@
+package lbalgos
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+const (
+	// time constant for the latency moving average decay
+	ewmaDecay = 10 * time.Second
+	// latency assumed for servers without observations yet
+	ewmaDefaultLatency = 100 * time.Millisecond
+	// latency recorded for failed requests
+	ewmaFailurePenalty = time.Second
+)
+
+// P2CEWMA implements power of two choices with peak ewma scoring,
+// it samples two servers at random and picks the one with the lower
+// latency ewma * (in-flight requests + 1) score
+type P2CEWMA struct {
+	servers []types.Server
+	stats   map[string]*ewmaStat
+	mu      *sync.Mutex
+}
+
+// peak ewma latency of a server, spikes immediately on slower samples
+// and decays towards faster ones over time
+type ewmaStat struct {
+	latency  float64 // nanoseconds
+	lastSeen time.Time
+}
+
+func NewP2CEWMA() *P2CEWMA {
+	return &P2CEWMA{
+		servers: []types.Server{},
+		stats:   map[string]*ewmaStat{},
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (p *P2CEWMA) AddServer(server types.Server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := slices.IndexFunc(p.servers, isSameAddr(server)); i == -1 {
+		p.servers = append(p.servers, server)
+	}
+}
+
+func (p *P2CEWMA) RemoveServer(server types.Server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.servers = slices.DeleteFunc(p.servers, isSameAddr(server))
+}
+
+func (p *P2CEWMA) NextServer(ctx *types.RequestContext) types.Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	servers := slices.DeleteFunc(slices.Clone(p.servers), func(s types.Server) bool {
+		return !s.IsAvailable()
+	})
+	switch len(servers) {
+	case 0:
+		return nil
+	case 1:
+		return servers[0]
+	}
+
+	i := rand.IntN(len(servers))
+	j := rand.IntN(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := servers[i], servers[j]
+	if p.score(b) < p.score(a) {
+		return b
+	}
+	return a
+}
+
+// records the observed latency in the server's peak ewma
+func (p *P2CEWMA) ObserveRequest(server types.Server, latency time.Duration, err error) {
+	if err != nil && latency < ewmaFailurePenalty {
+		latency = ewmaFailurePenalty
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	sample := float64(latency)
+	stat, ok := p.stats[server.GetAddr()]
+	if !ok {
+		p.stats[server.GetAddr()] = &ewmaStat{latency: sample, lastSeen: now}
+		return
+	}
+	if sample > stat.latency {
+		stat.latency = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(stat.lastSeen)) / float64(ewmaDecay))
+		stat.latency = stat.latency*w + sample*(1-w)
+	}
+	stat.lastSeen = now
+}
+
+// load score of the server, caller must hold the mutex
+func (p *P2CEWMA) score(server types.Server) float64 {
+	latency := float64(ewmaDefaultLatency)
+	if stat, ok := p.stats[server.GetAddr()]; ok {
+		latency = stat.latency
+	}
+	return latency * float64(server.GetConnectionsCount()+1)
+}
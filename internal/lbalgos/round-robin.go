@@ -2,39 +2,52 @@ package lbalgos
 
 import (
 	"slices"
-	"sync/atomic"
+	"sync"
 
 	"github.com/mohits-git/load-balancer/internal/types"
 )
 
 type RoundRobin struct {
-	current atomic.Int32
+	current int
 	servers []types.Server
+	mu      *sync.Mutex
 }
 
 func NewRoundRobinAlgo() types.LoadBalancingAlgorithm {
 	return &RoundRobin{
-		current: atomic.Int32{},
+		current: 0,
 		servers: make([]types.Server, 0),
+		mu:      &sync.Mutex{},
 	}
 }
 
 func (rb *RoundRobin) AddServer(server types.Server) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
 	if i := slices.IndexFunc(rb.servers, isSameAddr(server)); i == -1 {
 		rb.servers = append(rb.servers, server)
 	}
 }
 
 func (rb *RoundRobin) RemoveServer(server types.Server) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
 	rb.servers = slices.DeleteFunc(rb.servers, isSameAddr(server))
 }
 
-func (rb *RoundRobin) NextServer() types.Server {
-	currIndex := rb.current.Load()
+func (rb *RoundRobin) NextServer(ctx *types.RequestContext) types.Server {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
 	if len(rb.servers) == 0 {
 		return nil
 	}
-	nextIndex := (int(currIndex) + 1) % len(rb.servers)
-	rb.current.Store(int32(nextIndex))
-	return rb.servers[currIndex]
+	// servers may have been removed since the last pick
+	for range len(rb.servers) {
+		currIndex := rb.current % len(rb.servers)
+		rb.current = (currIndex + 1) % len(rb.servers)
+		if rb.servers[currIndex].IsAvailable() {
+			return rb.servers[currIndex]
+		}
+	}
+	return nil
 }
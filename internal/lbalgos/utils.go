@@ -7,3 +7,11 @@ func isSameAddr(server types.Server) func(e types.Server) bool {
 		return e.GetAddr() == server.GetAddr()
 	}
 }
+
+// returns server's weight, servers without a valid weight count as 1
+func positiveWeight(server types.Server) int {
+	if w := server.GetWeight(); w > 0 {
+		return w
+	}
+	return 1
+}
@@ -0,0 +1,71 @@
+package lbalgos
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+// WeightedLeastConnections picks the server with the lowest
+// in-flight connections to weight ratio
+type WeightedLeastConnections struct {
+	current int
+	servers []types.Server
+	mu      *sync.Mutex
+}
+
+func NewWeightedLeastConnections() *WeightedLeastConnections {
+	return &WeightedLeastConnections{
+		current: 0,
+		servers: []types.Server{},
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (w *WeightedLeastConnections) AddServer(server types.Server) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if i := slices.IndexFunc(w.servers, isSameAddr(server)); i == -1 {
+		w.servers = append(w.servers, server)
+	}
+}
+
+func (w *WeightedLeastConnections) RemoveServer(server types.Server) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.servers = slices.DeleteFunc(w.servers, isSameAddr(server))
+}
+
+func (w *WeightedLeastConnections) NextServer(ctx *types.RequestContext) types.Server {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.servers) == 0 {
+		return nil
+	}
+
+	start := w.current % len(w.servers)
+	best := -1
+	for i := range len(w.servers) {
+		idx := (start + i) % len(w.servers)
+		if !w.servers[idx].IsAvailable() {
+			continue
+		}
+		if best == -1 || lessLoaded(w.servers[idx], w.servers[best]) {
+			best = idx
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+
+	w.current = best + 1
+	return w.servers[best]
+}
+
+// reports whether a has a lower connections/weight ratio than b,
+// compared by cross multiplication to avoid floating point division
+func lessLoaded(a, b types.Server) bool {
+	return a.GetConnectionsCount()*positiveWeight(b) < b.GetConnectionsCount()*positiveWeight(a)
+}
@@ -4,68 +4,113 @@ import (
 	"log"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/mohits-git/load-balancer/internal/types"
 )
 
+// WeightedRoundRobin is nginx's smooth weighted round robin,
+// picks are interleaved (weights 5,1,1 give a a b a c a a instead of a a a a a b c)
 type WeightedRoundRobin struct {
-	current int
-	servers []types.Server
-	weights []int
-	mu      *sync.Mutex
+	peers []*wrrPeer
+	mu    *sync.Mutex
+}
+
+// per server state, kept with the server so adding or removing
+// other servers doesn't misalign it
+type wrrPeer struct {
+	server types.Server
+	// configured weight the effective weight was derived from
+	weight int
+	// weight currently used for picking, lowered on failures and
+	// recovered by one on every pick
+	effectiveWeight int
+	currentWeight   int
 }
 
 func NewWeightedRoundRobin() *WeightedRoundRobin {
 	return &WeightedRoundRobin{
-		current: 0,
-		servers: []types.Server{},
-		weights: []int{},
-		mu:      &sync.Mutex{},
+		peers: []*wrrPeer{},
+		mu:    &sync.Mutex{},
 	}
 }
 
 func (w *WeightedRoundRobin) AddServer(server types.Server) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if i := slices.IndexFunc(w.servers, isSameAddr(server)); i == -1 {
-		w.servers = append(w.servers, server)
-		w.weights = append(w.weights, server.GetWeight())
+	if i := w.indexOf(server); i == -1 {
+		weight := positiveWeight(server)
+		w.peers = append(w.peers, &wrrPeer{
+			server:          server,
+			weight:          weight,
+			effectiveWeight: weight,
+		})
 	}
 }
 
 func (w *WeightedRoundRobin) RemoveServer(server types.Server) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if i := slices.IndexFunc(w.servers, isSameAddr(server)); i != -1 {
+	if i := w.indexOf(server); i != -1 {
 		log.Println("Removing server", server.GetAddr())
-		w.servers = append(w.servers[:i], w.servers[i+1:]...)
-		w.weights = append(w.weights[:i], w.weights[i+1:]...)
+		w.peers = slices.Delete(w.peers, i, i+1)
 	}
 }
 
-func (w *WeightedRoundRobin) NextServer() types.Server {
+func (w *WeightedRoundRobin) NextServer(ctx *types.RequestContext) types.Server {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	currIndex := w.current
+	var best *wrrPeer
+	total := 0
+	for _, peer := range w.peers {
+		if !peer.server.IsAvailable() {
+			continue
+		}
+		// pick up weights changed at runtime with SetWeight
+		if weight := positiveWeight(peer.server); weight != peer.weight {
+			peer.effectiveWeight = max(1, peer.effectiveWeight+weight-peer.weight)
+			peer.weight = weight
+		}
+		if peer.effectiveWeight > peer.weight {
+			peer.effectiveWeight = peer.weight
+		}
 
-	if len(w.servers) == 0 {
-		return nil
+		peer.currentWeight += peer.effectiveWeight
+		total += peer.effectiveWeight
+		if best == nil || peer.currentWeight > best.currentWeight {
+			best = peer
+		}
+		// slowly recover weight lost to failures
+		if peer.effectiveWeight < peer.weight {
+			peer.effectiveWeight++
+		}
 	}
 
-	if currIndex >= len(w.servers) {
-		currIndex = 0
+	if best == nil {
+		return nil
 	}
+	best.currentWeight -= total
+	return best.server
+}
 
-	currWeight := w.weights[currIndex]
-	if currWeight == 0 {
-		w.weights[currIndex] = w.servers[currIndex].GetWeight()
-		currIndex = (currIndex + 1) % len(w.servers)
-		currWeight = w.weights[currIndex]
+// lowers the effective weight of servers that just failed so they get
+// less traffic until they recover
+func (w *WeightedRoundRobin) ObserveRequest(server types.Server, latency time.Duration, err error) {
+	if err == nil {
+		return
 	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if i := w.indexOf(server); i != -1 {
+		peer := w.peers[i]
+		peer.effectiveWeight = max(0, peer.effectiveWeight-peer.weight)
+	}
+}
 
-	w.weights[currIndex] = currWeight - 1
-
-	w.current = currIndex
-	return w.servers[currIndex]
+// caller must hold the mutex
+func (w *WeightedRoundRobin) indexOf(server types.Server) int {
+	return slices.IndexFunc(w.peers, func(p *wrrPeer) bool {
+		return p.server.GetAddr() == server.GetAddr()
+	})
 }
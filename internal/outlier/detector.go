@@ -0,0 +1,152 @@
+// outlier implements passive health checking, backends failing live traffic
+// are ejected from load balancing for an escalating period of time
+package outlier
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mohits-git/load-balancer/internal/types"
+)
+
+type Config struct {
+	// consecutive failures (connect errors, 5xx, timeouts) before ejection
+	ConsecutiveErrors int
+	// ejection period is BaseEjectionTime * number of times the server was ejected
+	BaseEjectionTime time.Duration
+	// upper bound of the ejection period
+	MaxEjectionTime time.Duration
+	// max percentage of servers ejected at once, at least one server can always be ejected
+	MaxEjectionPercent int
+}
+
+// Detector tracks consecutive failures per server and ejects outliers,
+// ejected servers come back through the active health checker once their
+// ejection period is over
+type Detector struct {
+	cfg   Config
+	hosts map[string]*hostState
+	eject func(types.Server)
+	mu    *sync.Mutex
+}
+
+type hostState struct {
+	consecutiveErrors int
+	// number of ejections, grows the ejection period
+	ejections    int
+	ejected      bool
+	ejectedUntil time.Time
+	returnedAt   time.Time
+}
+
+// returns a new detector calling eject to take a server out of load balancing
+func NewDetector(cfg Config, eject func(types.Server)) *Detector {
+	if cfg.ConsecutiveErrors <= 0 {
+		cfg.ConsecutiveErrors = 5
+	}
+	if cfg.BaseEjectionTime <= 0 {
+		cfg.BaseEjectionTime = 30 * time.Second
+	}
+	if cfg.MaxEjectionTime < cfg.BaseEjectionTime {
+		cfg.MaxEjectionTime = max(300*time.Second, cfg.BaseEjectionTime)
+	}
+	if cfg.MaxEjectionPercent <= 0 || cfg.MaxEjectionPercent > 100 {
+		cfg.MaxEjectionPercent = 10
+	}
+	return &Detector{
+		cfg:   cfg,
+		hosts: map[string]*hostState{},
+		eject: eject,
+		mu:    &sync.Mutex{},
+	}
+}
+
+// starts tracking the server, tracked servers are the base for MaxEjectionPercent
+func (d *Detector) AddServer(server types.Server) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.hosts[server.GetAddr()]; !ok {
+		d.hosts[server.GetAddr()] = &hostState{}
+	}
+}
+
+// records a successful request, resets the server's consecutive failures
+func (d *Detector) ReportSuccess(server types.Server) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	host, ok := d.hosts[server.GetAddr()]
+	if !ok {
+		return
+	}
+	host.consecutiveErrors = 0
+	// forget old ejections once the server stayed healthy long enough
+	if host.ejections > 0 && !host.ejected && time.Since(host.returnedAt) > d.cfg.MaxEjectionTime {
+		host.ejections = 0
+	}
+}
+
+// records a failed request, ejects the server when it reaches the
+// consecutive failures limit and the max ejection percentage allows it
+func (d *Detector) ReportFailure(server types.Server, reason string) {
+	d.mu.Lock()
+	host, ok := d.hosts[server.GetAddr()]
+	if !ok || host.ejected {
+		d.mu.Unlock()
+		return
+	}
+	host.consecutiveErrors++
+	if host.consecutiveErrors < d.cfg.ConsecutiveErrors || !d.canEject() {
+		d.mu.Unlock()
+		return
+	}
+
+	host.ejected = true
+	host.ejections++
+	host.consecutiveErrors = 0
+	period := min(d.cfg.BaseEjectionTime*time.Duration(host.ejections), d.cfg.MaxEjectionTime)
+	host.ejectedUntil = time.Now().Add(period)
+	d.mu.Unlock()
+
+	log.Printf("Ejecting server %s for %v after consecutive failures (last: %s)\n", server.GetAddr(), period, reason)
+	d.eject(server)
+}
+
+// reports whether the server is out of its ejection period and can be brought back,
+// marks the server as returned when it is
+func (d *Detector) TryReturn(server types.Server) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	host, ok := d.hosts[server.GetAddr()]
+	if !ok || !host.ejected {
+		return true
+	}
+	if time.Now().Before(host.ejectedUntil) {
+		return false
+	}
+	host.ejected = false
+	host.returnedAt = time.Now()
+	return true
+}
+
+// caller must hold the mutex
+func (d *Detector) canEject() bool {
+	ejected := 0
+	for _, host := range d.hosts {
+		if host.ejected {
+			ejected++
+		}
+	}
+	return ejected < max(1, len(d.hosts)*d.cfg.MaxEjectionPercent/100)
+}
+
+// describes a request error for failure reports
+func ErrorReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "connect error"
+}
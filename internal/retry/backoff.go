@@ -0,0 +1,51 @@
+// retry implements the backoff between retries and the retry budget
+// shared by the load balancers
+package retry
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+type Backoff struct {
+	// delay ceiling of the first retry, doubles with every retry
+	Base time.Duration
+	// upper bound of the delay ceiling
+	Max time.Duration
+}
+
+// fills unset values with the defaults (25ms base, 1s max)
+func (b Backoff) WithDefaults() Backoff {
+	if b.Base <= 0 {
+		b.Base = 25 * time.Millisecond
+	}
+	if b.Max < b.Base {
+		b.Max = max(time.Second, b.Base)
+	}
+	return b
+}
+
+// returns the delay before the retry (1 for the first one), picked uniformly
+// between 0 and min(Max, Base * 2^(retry-1)) ("full jitter") so retries
+// of many clients don't line up
+func (b Backoff) Delay(retry int) time.Duration {
+	ceiling := b.Max
+	if shift := retry - 1; shift < 32 && b.Base<<shift < b.Max && b.Base<<shift > 0 {
+		ceiling = b.Base << shift
+	}
+	return rand.N(ceiling + 1)
+}
+
+// waits for the retry's delay, returns the context's error when it's
+// done first (e.g. the client went away)
+func (b Backoff) Wait(ctx context.Context, retry int) error {
+	timer := time.NewTimer(b.Delay(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,93 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+type BudgetConfig struct {
+	// retries allowed as a percentage of the requests in the window
+	Percent float64
+	// retries always allowed in the window, so low traffic can still retry
+	MinRetries int
+	// sliding window requests and retries are counted in
+	Window time.Duration
+}
+
+// Budget caps retries to a percentage of recent requests so retries can't
+// multiply the load on backends during an outage. a nil budget allows every retry
+type Budget struct {
+	cfg     BudgetConfig
+	buckets []budgetBucket
+	mu      *sync.Mutex
+}
+
+// requests and retries of one second of the window
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// returns a new budget, unset values default to 20 percent,
+// 10 retries and a 10 seconds window
+func NewBudget(cfg BudgetConfig) *Budget {
+	if cfg.Percent <= 0 {
+		cfg.Percent = 20
+	}
+	if cfg.MinRetries <= 0 {
+		cfg.MinRetries = 10
+	}
+	if cfg.Window < time.Second {
+		cfg.Window = 10 * time.Second
+	}
+	return &Budget{
+		cfg:     cfg,
+		buckets: make([]budgetBucket, int(cfg.Window/time.Second)),
+		mu:      &sync.Mutex{},
+	}
+}
+
+// counts an incoming request
+func (b *Budget) RecordRequest() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).requests++
+}
+
+// reports whether a retry is allowed and counts it when it is
+func (b *Budget) TryRetry() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	requests, retries := 0, 0
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+	allowed := max(float64(b.cfg.MinRetries), float64(requests)*b.cfg.Percent/100)
+	if float64(retries) >= allowed {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// returns the bucket of the current second, resetting it when it held an older second
+func (b *Budget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = budgetBucket{second: second}
+	}
+	return bucket
+}
@@ -0,0 +1,58 @@
+// tlsconfig builds crypto/tls configurations from load balancer settings
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ClientOptions configures tls connections made by the load balancer to backends
+type ClientOptions struct {
+	// pem CA bundle used to verify the backend, system roots when empty
+	CAFile string
+	// overrides the server name used for verification and SNI
+	ServerName string
+	// disables backend certificate verification, only meant for development
+	InsecureSkipVerify bool
+	// pem client certificate and key presented to the backend (mutual tls)
+	CertFile string
+	KeyFile  string
+}
+
+// returns the client tls config for the options
+func NewClientConfig(opts ClientOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %s: %w", opts.CertFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// reads a pem encoded certificate bundle into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA file %s: %w", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in CA file %s", file)
+	}
+	return pool, nil
+}
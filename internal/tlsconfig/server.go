@@ -0,0 +1,200 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// default interval between checks for changed certificate files
+const defaultReloadInterval = 10 * time.Second
+
+// ServerOptions configures tls termination on the load balancer listener
+type ServerOptions struct {
+	// certificates are picked by the client's SNI, the first one is the default
+	Certificates []CertKeyPair
+	// "1.0" | "1.1" | "1.2" | "1.3", defaults to crypto/tls's default
+	MinVersion string
+	// cipher suite names (tls 1.0-1.2 only), defaults to crypto/tls's default
+	CipherSuites []string
+	// protocols advertised with ALPN
+	ALPN []string
+	// how often certificate files are checked for changes
+	ReloadInterval time.Duration
+	// client certificate verification: "none" (default) | "optional" | "required"
+	ClientAuth string
+	// pem CA bundle client certificates are verified against
+	ClientCAFile string
+}
+
+// pem encoded certificate chain and private key files
+type CertKeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// returns the listener tls config for the options, certificates are
+// reloaded from disk when their files change, without affecting open connections
+func NewServerConfig(opts ServerOptions) (*tls.Config, error) {
+	if len(opts.Certificates) == 0 {
+		return nil, errors.New("No certificates configured")
+	}
+	minVersion, err := parseVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(opts.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &certStore{pairs: opts.Certificates}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	interval := opts.ReloadInterval
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	clientAuth, err := parseClientAuth(opts.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		NextProtos:     opts.ALPN,
+		ClientAuth:     clientAuth,
+	}
+	if clientAuth != tls.NoClientCert {
+		if opts.ClientCAFile == "" {
+			return nil, errors.New("Client CA file is required for client certificate authentication")
+		}
+		if cfg.ClientCAs, err = loadCertPool(opts.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	go store.watch(interval)
+	return cfg, nil
+}
+
+// certStore holds the loaded certificates and swaps them atomically on reload
+type certStore struct {
+	pairs   []CertKeyPair
+	certs   atomic.Pointer[[]*tls.Certificate]
+	modTime time.Time
+}
+
+// loads all certificates, the current ones are kept when any of them fails to load
+func (s *certStore) load() error {
+	certs := make([]*tls.Certificate, 0, len(s.pairs))
+	var modTime time.Time
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Error loading certificate %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+		modTime = latest(modTime, pair.CertFile, pair.KeyFile)
+	}
+	s.certs.Store(&certs)
+	s.modTime = modTime
+	return nil
+}
+
+// reloads the certificates whenever one of the files changes
+func (s *certStore) watch(interval time.Duration) {
+	for {
+		<-time.After(interval)
+		var modTime time.Time
+		for _, pair := range s.pairs {
+			modTime = latest(modTime, pair.CertFile, pair.KeyFile)
+		}
+		if !modTime.After(s.modTime) {
+			continue
+		}
+		if err := s.load(); err != nil {
+			log.Println("Error reloading certificates, keeping the current ones", err)
+			continue
+		}
+		log.Println("Reloaded tls certificates")
+	}
+}
+
+// picks the first certificate valid for the client hello (SNI, exact or
+// wildcard match), falls back to the first certificate
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *s.certs.Load()
+	if hello.ServerName != "" {
+		for _, cert := range certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+// returns the latest of t and the files' modification times
+func latest(t time.Time, files ...string) time.Time {
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+func parseVersion(version string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Invalid tls version %q", version)
+}
+
+func parseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "required":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("Invalid client auth mode %q", mode)
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,74 @@
+// tunnel pipes bytes between two connections, used for tcp proxying
+// and upgraded (e.g. websocket) http connections
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// closeWriter is implemented by connections supporting tcp half-close
+// (e.g. *net.TCPConn, *tls.Conn)
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data between the client and backend connections in both
+// directions until both sides are done, returns bytes sent to and received from backend
+func Pipe(client, backend net.Conn) (sent, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent = copyAndCloseWrite(backend, client)
+	}()
+	go func() {
+		defer wg.Done()
+		received = copyAndCloseWrite(client, backend)
+	}()
+	wg.Wait()
+	return sent, received
+}
+
+// copies src to dst until src reaches EOF, then half-closes dst so the peer
+// sees the EOF while the other direction keeps flowing.
+// on any other error both connections are closed to unblock the other direction
+func copyAndCloseWrite(dst, src net.Conn) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		src.Close()
+		return n
+	}
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return n
+}
+
+// BufferedConn reads from r instead of the underlying connection, used when
+// bytes were already consumed while reading a handshake (r replays them and
+// continues with the connection, e.g. a *bufio.Reader wrapping it)
+type BufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func NewBufferedConn(conn net.Conn, r io.Reader) *BufferedConn {
+	return &BufferedConn{Conn: conn, r: r}
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// half-closes the underlying connection when supported, closes it otherwise
+func (c *BufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
@@ -1,7 +1,18 @@
 package types
 
+import "time"
+
 type LoadBalancingAlgorithm interface {
 	AddServer(Server)
 	RemoveServer(Server)
-	NextServer() Server
+	// picks the next server for the request, ctx can be nil
+	NextServer(ctx *RequestContext) Server
+}
+
+// RequestObserver is implemented by algorithms that adapt to observed
+// backend behaviour, servers report every request/dial outcome to it
+type RequestObserver interface {
+	// latency is the time taken to get response headers (http) or connect (tcp),
+	// err is non nil when the request or dial failed
+	ObserveRequest(server Server, latency time.Duration, err error)
 }
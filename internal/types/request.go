@@ -0,0 +1,29 @@
+package types
+
+import "net/http"
+
+// RequestContext describes the incoming client connection or request,
+// algorithms can use it to route by client or request attributes
+// Host, Path and Header are only set for http requests
+type RequestContext struct {
+	Protocol   string // "tcp" | "http"
+	ClientIP   string
+	ClientPort string
+	LocalAddr  string // load balancer address the client connected to (ip:port)
+	Host       string
+	Path       string
+	Header     http.Header
+}
+
+// returns the value of the named cookie sent with the request, empty if missing
+func (c *RequestContext) Cookie(name string) string {
+	if c == nil || c.Header == nil {
+		return ""
+	}
+	req := http.Request{Header: c.Header}
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
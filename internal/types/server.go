@@ -8,4 +8,6 @@ type Server interface {
 	SetWeight(int)
 	GetConnectionsCount() int
 	IsHealthy() bool
+	// false while the server's circuit breaker rejects requests
+	IsAvailable() bool
 }
@@ -0,0 +1,113 @@
+// grpc-health is a local grpc.health.v1.Health/Check stub for testing
+// grpc health checks, it serves cleartext http/2 (h2c)
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var PORT = ":50051"
+
+// serving status returned for every service, SERVING unless STATUS env says otherwise
+var servingStatus uint64 = 1
+
+var statuses = map[string]uint64{
+	"UNKNOWN":         0,
+	"SERVING":         1,
+	"NOT_SERVING":     2,
+	"SERVICE_UNKNOWN": 3,
+}
+
+// services known to the stub, any service when SERVICES env is empty
+var services = map[string]bool{}
+
+func HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "grpc over http/2 expected", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	service, err := readHealthCheckRequest(r.Body)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "13") // INTERNAL
+		w.Header().Set("Grpc-Message", err.Error())
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	status := servingStatus
+	if len(services) > 0 && service != "" && !services[service] {
+		status = statuses["SERVICE_UNKNOWN"]
+	}
+	log.Printf("Health check for service %q, replying with status %d\n", service, status)
+
+	msg := binary.AppendUvarint([]byte{0x08}, status) // field 1, varint
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(frame, msg...))
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("Grpc-Message", "")
+}
+
+// reads the service name from a length prefixed HealthCheckRequest message
+func readHealthCheckRequest(r io.Reader) (string, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", fmt.Errorf("error reading message header: %w", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", fmt.Errorf("error reading message: %w", err)
+	}
+	// only field 1 (service, length delimited) is expected
+	if len(msg) == 0 {
+		return "", nil
+	}
+	if msg[0] != 0x0a {
+		return "", fmt.Errorf("unexpected field tag %d", msg[0])
+	}
+	l, n := binary.Uvarint(msg[1:])
+	if n <= 0 || uint64(len(msg)-1-n) < l {
+		return "", fmt.Errorf("malformed service field")
+	}
+	return string(msg[1+n : 1+n+int(l)]), nil
+}
+
+func main() {
+	if port := os.Getenv("PORT"); port != "" {
+		PORT = ":" + port
+	}
+	if status := os.Getenv("STATUS"); status != "" {
+		s, ok := statuses[status]
+		if !ok {
+			log.Fatalf("Invalid STATUS %q, use SERVING | NOT_SERVING | SERVICE_UNKNOWN | UNKNOWN", status)
+		}
+		servingStatus = s
+	}
+	for _, service := range strings.Split(os.Getenv("SERVICES"), ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			services[service] = true
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /grpc.health.v1.Health/Check", HandleHealthCheck)
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: PORT, Handler: mux, Protocols: &protocols}
+
+	fmt.Println("gRPC health stub listening on port", PORT)
+	log.Fatal(server.ListenAndServe())
+}